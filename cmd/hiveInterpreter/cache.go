@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Methods returning head state, which changes with every block. Rather than expiring on a timer, their cache
+// entries are refreshed as soon as the head block advances.
+var headStateMethods = map[string]bool{
+	"get_dynamic_global_properties":    true,
+	"get_witness_schedule":             true,
+	"get_feed_history":                 true,
+	"get_ticker":                       true,
+	"get_current_median_history_price": true,
+	"get_order_book":                   true,
+	"get_active_witnesses":             true,
+	"get_reward_fund":                  true,
+}
+
+const (
+	// Backstop expiry for head state entries, should refreshing fail.
+	headStateCacheTime = 2 * blockInterval
+	// Entries that have not been requested for this long are no longer refreshed.
+	headStateIdle = 30 * time.Second
+	// Refreshes run at once, per block.
+	headStateRefreshers = 8
+)
+
+// A cached head state request, to be refreshed on each block.
+type headStateEntry struct {
+	requestJson []byte
+	target      string
+	method      string
+	rest        bool // Cached in REST form.
+	lastHit     atomic.Int64
+}
+
+var headState = struct {
+	sync.RWMutex
+	entries map[string]*headStateEntry
+}{entries: make(map[string]*headStateEntry)}
+
+// Registers a cached head state response to be refreshed on each block.
+func trackHeadState(key string, target string, method string, requestJson []byte, rest bool) {
+	headState.Lock()
+	defer headState.Unlock()
+	e, ok := headState.entries[key]
+	if !ok {
+		e = &headStateEntry{requestJson: requestJson, target: target, method: method, rest: rest}
+		headState.entries[key] = e
+	}
+	e.lastHit.Store(time.Now().UnixNano())
+}
+
+// Records a cache hit on a head state entry, so that it keeps being refreshed.
+func touchHeadState(key string) {
+	headState.RLock()
+	defer headState.RUnlock()
+	if e, ok := headState.entries[key]; ok {
+		e.lastHit.Store(time.Now().UnixNano())
+	}
+}
+
+// Refreshes head state entries whenever the head block advances, until shutdown.
+func startHeadStateRefresher() {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		for {
+			select {
+			case <-head.nextBlock():
+				refreshHeadState()
+			case <-shutdownCtx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Re-fetches every recently requested head state entry. Entries that fail to refresh are dropped from the cache,
+// so that clients never see the previous block's state for longer than a fetch takes.
+func refreshHeadState() {
+	idleBefore := time.Now().Add(-headStateIdle).UnixNano()
+	refresh := make(map[string]*headStateEntry)
+	headState.Lock()
+	for key, e := range headState.entries {
+		if e.lastHit.Load() < idleBefore {
+			delete(headState.entries, key)
+			continue
+		}
+		refresh[key] = e
+	}
+	headState.Unlock()
+
+	sem := make(chan struct{}, headStateRefreshers)
+	var wg sync.WaitGroup
+	for key, e := range refresh {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			status, respJson := requestToResponseBytes(internalJobContext(context.Background(), e.method), ep2pool[e.target], e.requestJson)
+			ok := status == http.StatusOK
+			if ok && e.rest {
+				respJson, ok = formatRESTResponse(respJson)
+			}
+			if !ok {
+				if debug {
+					log.Println("Head state refresh failed:", status, string(e.requestJson))
+				}
+				respcache.Delete(key)
+				return
+			}
+			respcache.Set(key, newCacheEntry(respJson), headStateCacheTime)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Layout of timestamps on chain.
+const chainTimeLayout = "2006-01-02T15:04:05"
+
+// Standard json RPC response envelope, as returned by an upstream.
+type rpcResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+	ID      interface{}     `json:"id"`
+}
+
+// Error object of a json RPC response.
+type rpcError struct {
+	Code    int64       `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return "rpc error " + strconv.FormatInt(e.Code, 10) + ": " + e.Message
+}
+
+// An error that should be reported to the client with a specific http status.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	if e.msg == "" {
+		return http.StatusText(e.status)
+	}
+	return e.msg
+}
+
+// Creates a statusError, using the standard status text if no message is given.
+func newStatusError(status int, msg string) *statusError {
+	return &statusError{status: status, msg: msg}
+}
+
+// Asset in appbase (NAI) form.
+type naiAsset struct {
+	Amount    string `json:"amount"`
+	Precision int    `json:"precision"`
+	Nai       string `json:"nai"`
+}
+
+// Fields of database_api.get_dynamic_global_properties that the interpreter makes use of.
+type dynamicGlobalProperties struct {
+	HeadBlockNumber          int64    `json:"head_block_number"`
+	HeadBlockID              string   `json:"head_block_id"`
+	Time                     string   `json:"time"`
+	LastIrreversibleBlockNum int64    `json:"last_irreversible_block_num"`
+	CurrentSupply            naiAsset `json:"current_supply"`
+	VirtualSupply            naiAsset `json:"virtual_supply"`
+	CurrentHbdSupply         naiAsset `json:"current_hbd_supply"`
+}
+
+// Result of block_api.get_block_header.
+type blockHeaderResult struct {
+	Header *blockHeader `json:"header"`
+}
+
+type blockHeader struct {
+	Previous  string `json:"previous"`
+	Timestamp string `json:"timestamp"`
+	Witness   string `json:"witness"`
+}
+
+// Result of block_api.get_block.
+type blockResult struct {
+	Block *signedBlock `json:"block"`
+}
+
+type signedBlock struct {
+	blockHeader
+	BlockID        string              `json:"block_id"`
+	Transactions   []signedTransaction `json:"transactions"`
+	TransactionIDs []string            `json:"transaction_ids"`
+}
+
+type signedTransaction struct {
+	Operations []operation `json:"operations"`
+}
+
+// An appbase style operation, e.g. {"type": "comment_operation", "value": {...}}.
+type operation struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+type commentOperation struct {
+	Author   string `json:"author"`
+	Permlink string `json:"permlink"`
+	Body     string `json:"body"`
+}
+
+// Result of condenser_api.get_content.
+type discussion struct {
+	Author     string `json:"author"`
+	Permlink   string `json:"permlink"`
+	Body       string `json:"body"`
+	Created    string `json:"created"`
+	LastUpdate string `json:"last_update"`
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Responses smaller than this are sent uncompressed.
+	compressMinSize = 1024
+	// Cache entries smaller than this are stored uncompressed.
+	cacheCompressMinSize = 4096
+)
+
+// Encoding used to store large cache entries, set from flags.
+var cacheEncoding = "gzip"
+
+// Encodings understood, in order of preference.
+var supportedEncodings = []string{"zstd", "gzip"}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+var zstdWriters = sync.Pool{New: func() interface{} {
+	zw, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	return zw
+}}
+
+// Shared zstd decoder, safe for concurrent use with DecodeAll.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+
+// A cached response, possibly stored compressed.
+type cacheEntry struct {
+	body []byte
+	enc  string // Content-Encoding of body, empty if uncompressed.
+}
+
+// Makes a cache entry for a response, compressing it if large enough.
+func newCacheEntry(resp []byte) cacheEntry {
+	if len(resp) < cacheCompressMinSize {
+		return cacheEntry{body: resp}
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(resp) / 4)
+	zw := getEncoder(cacheEncoding, &buf)
+	_, err := zw.Write(resp)
+	if err == nil {
+		err = zw.Close()
+	}
+	putEncoder(cacheEncoding, zw)
+	if err != nil || buf.Len() >= len(resp) {
+		return cacheEntry{body: resp}
+	}
+	return cacheEntry{body: buf.Bytes(), enc: cacheEncoding}
+}
+
+// The uncompressed response.
+func (ce cacheEntry) bytes() ([]byte, error) {
+	switch ce.enc {
+	case "":
+		return ce.body, nil
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(ce.body))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	case "zstd":
+		return zstdDecoder.DecodeAll(ce.body, nil)
+	}
+	return nil, errors.New("unknown cache encoding " + ce.enc)
+}
+
+// Writes a compressed entry as is, if the client accepts its encoding. Returns false, having written nothing, otherwise.
+func writeEncoded(w http.ResponseWriter, r *http.Request, ce cacheEntry) bool {
+	if ce.enc == "" || !acceptsEncoding(r, ce.enc) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", ce.enc)
+	w.Header().Set("Content-Length", strconv.Itoa(len(ce.body)))
+	w.Write(ce.body)
+	return true
+}
+
+func getEncoder(enc string, w io.Writer) io.WriteCloser {
+	if enc == "zstd" {
+		zw := zstdWriters.Get().(*zstd.Encoder)
+		zw.Reset(w)
+		return zw
+	}
+	zw := gzipWriters.Get().(*gzip.Writer)
+	zw.Reset(w)
+	return zw
+}
+
+func putEncoder(enc string, zw io.WriteCloser) {
+	if enc == "zstd" {
+		zstdWriters.Put(zw)
+	} else {
+		gzipWriters.Put(zw)
+	}
+}
+
+// Quality values of the encodings a request accepts.
+func acceptedEncodings(r *http.Request) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, h := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(h, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+			accepted[strings.ToLower(strings.TrimSpace(name))] = q
+		}
+	}
+	return accepted
+}
+
+func acceptsEncoding(r *http.Request, enc string) bool {
+	accepted := acceptedEncodings(r)
+	if q, ok := accepted[enc]; ok {
+		return q > 0
+	}
+	return accepted["*"] > 0
+}
+
+// The encoding to compress a response to the request with, or empty for none.
+func preferredEncoding(r *http.Request) string {
+	accepted := acceptedEncodings(r)
+	best, bestq := "", 0.0
+	for _, enc := range supportedEncodings {
+		q, ok := accepted[enc]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestq {
+			best, bestq = enc, q
+		}
+	}
+	return best
+}
+
+// Compresses responses for clients that accept gzip or zstd. Responses the handler has already encoded,
+// and small ones, are passed through.
+func compressHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := preferredEncoding(r)
+		if enc == "" || websocket.IsWebSocketUpgrade(r) {
+			h(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, enc: enc}
+		defer cw.close()
+		h(cw, r)
+	}
+}
+
+// Buffers the start of a response to decide whether it is worth compressing, then streams it through an encoder.
+type compressWriter struct {
+	http.ResponseWriter
+	enc         string
+	status      int
+	buf         []byte
+	zw          io.WriteCloser
+	passthrough bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.passthrough {
+		return cw.ResponseWriter.Write(p)
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(p)
+	}
+	if cw.Header().Get("Content-Encoding") != "" || (cw.status != 0 && cw.status != http.StatusOK) {
+		cw.startPassthrough()
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= compressMinSize {
+		if err := cw.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (cw *compressWriter) startPassthrough() {
+	cw.passthrough = true
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+}
+
+func (cw *compressWriter) startCompression() error {
+	hdr := cw.Header()
+	hdr.Set("Content-Encoding", cw.enc)
+	hdr.Del("Content-Length")
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	cw.zw = getEncoder(cw.enc, cw.ResponseWriter)
+	_, err := cw.zw.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// Finishes the response: closes the encoder, or writes out a response too small to compress.
+func (cw *compressWriter) close() {
+	switch {
+	case cw.zw != nil:
+		if err := cw.zw.Close(); err != nil && debug {
+			log.Println("Compressing response:", err)
+		}
+		putEncoder(cw.enc, cw.zw)
+	case !cw.passthrough:
+		cw.startPassthrough()
+		if len(cw.buf) > 0 {
+			cw.ResponseWriter.Write(cw.buf)
+		}
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// The positional parameters of a condenser_api method, in order. Query methods instead take their parameters
+// as the fields of a single object.
+type condenserSignature struct {
+	params  []restParam
+	query   bool
+	example string // A response, for the API document.
+}
+
+// Fields of the discussion query object.
+var discussionQuery = []restParam{
+	{name: "tag", kind: paramString},
+	{name: "limit", kind: paramInteger, def: 20},
+	{name: "start_author", kind: paramString},
+	{name: "start_permlink", kind: paramString},
+	{name: "truncate_body", kind: paramInteger},
+	{name: "filter_tags", kind: paramString, array: true},
+	{name: "select_authors", kind: paramString, array: true},
+	{name: "select_tags", kind: paramString, array: true},
+	{name: "observer", kind: paramString},
+}
+
+// A signature of one required parameter.
+func requiredParam(name string, kind string) []restParam {
+	return []restParam{{name: name, kind: kind, required: true}}
+}
+
+// Signatures of condenser_api methods, by method name. Methods that take a transaction are left out, since
+// they cannot be given as query values.
+var condenserSignatures = map[string]condenserSignature{
+	"get_account_count":                {},
+	"get_active_witnesses":             {},
+	"get_chain_properties":             {},
+	"get_config":                       {},
+	"get_current_median_history_price": {},
+	"get_dynamic_global_properties":    {},
+	"get_feed_history":                 {},
+	"get_hardfork_version":             {},
+	"get_market_history_buckets":       {},
+	"get_next_scheduled_hardfork":      {},
+	"get_ticker":                       {},
+	"get_version":                      {},
+	"get_volume":                       {},
+	"get_witness_count":                {},
+	"get_witness_schedule":             {},
+
+	"get_accounts": {params: []restParam{
+		{name: "names", kind: paramString, array: true, required: true},
+		{name: "delayed_votes_active", kind: paramBoolean},
+	}, example: `{"result": [{"id": 28, "name": "alice", "balance": "1.000 HIVE", "hbd_balance": "0.000 HBD", "vesting_shares": "2040.123456 VESTS", "post_count": 12}]}`},
+	"lookup_account_names": {params: []restParam{
+		{name: "names", kind: paramString, array: true, required: true},
+		{name: "delayed_votes_active", kind: paramBoolean},
+	}},
+	"lookup_accounts": {params: []restParam{
+		{name: "lower_bound_name", kind: paramString, required: true},
+		{name: "limit", kind: paramInteger, required: true},
+	}},
+	"get_account_history": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "start", kind: paramInteger, def: json.Number("-1"), desc: "Sequence number to page back from, -1 for the latest."},
+		{name: "limit", kind: paramInteger, def: json.Number("1000")},
+		{name: "operation_filter_low", kind: paramInteger},
+		{name: "operation_filter_high", kind: paramInteger},
+	}},
+	"get_account_reputations": {params: []restParam{
+		{name: "account_lower_bound", kind: paramString, required: true},
+		{name: "limit", kind: paramInteger, required: true},
+	}},
+	"get_account_votes":                      {params: requiredParam("voter", paramString)},
+	"get_collateralized_conversion_requests": {params: requiredParam("account", paramString)},
+	"get_conversion_requests":                {params: requiredParam("account", paramString)},
+	"get_open_orders":                        {params: requiredParam("account", paramString)},
+	"get_owner_history":                      {params: requiredParam("account", paramString)},
+	"get_recovery_request":                   {params: requiredParam("account", paramString)},
+	"get_savings_withdraw_from":              {params: requiredParam("account", paramString)},
+	"get_savings_withdraw_to":                {params: requiredParam("account", paramString)},
+	"get_witness_by_account":                 {params: requiredParam("account", paramString)},
+	"find_recurrent_transfers":               {params: requiredParam("account", paramString)},
+	"get_follow_count":                       {params: requiredParam("account", paramString)},
+	"get_tags_used_by_author":                {params: requiredParam("author", paramString)},
+	"get_key_references": {params: []restParam{
+		{name: "keys", kind: paramString, array: true, required: true},
+	}},
+	"get_withdraw_routes": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "type", kind: paramString, def: "outgoing", enum: []string{"outgoing", "incoming", "all"}},
+	}},
+	"get_vesting_delegations": {params: []restParam{
+		{name: "delegator", kind: paramString, required: true},
+		{name: "start_account", kind: paramString, def: ""},
+		{name: "limit", kind: paramInteger, def: 100},
+	}},
+	"get_expiring_vesting_delegations": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "start", kind: paramString, required: true, desc: "Chain time to list from."},
+		{name: "limit", kind: paramInteger, def: 100},
+	}},
+	"get_escrow": {params: []restParam{
+		{name: "from", kind: paramString, required: true},
+		{name: "escrow_id", kind: paramInteger, required: true},
+	}},
+
+	"get_block":        {params: requiredParam("block_num", paramInteger)},
+	"get_block_header": {params: requiredParam("block_num", paramInteger)},
+	"get_ops_in_block": {params: []restParam{
+		{name: "block_num", kind: paramInteger, required: true},
+		{name: "only_virtual", kind: paramBoolean, def: false},
+	}},
+	"get_transaction": {params: requiredParam("trx_id", paramString)},
+
+	"get_witnesses": {params: []restParam{
+		{name: "ids", kind: paramInteger, array: true, required: true},
+	}},
+	"get_witnesses_by_vote": {params: []restParam{
+		{name: "start_name", kind: paramString, def: ""},
+		{name: "limit", kind: paramInteger, def: 100},
+	}},
+	"lookup_witness_accounts": {params: []restParam{
+		{name: "lower_bound_name", kind: paramString, required: true},
+		{name: "limit", kind: paramInteger, required: true},
+	}},
+	"get_reward_fund": {params: requiredParam("name", paramString)},
+	"find_proposals": {params: []restParam{
+		{name: "ids", kind: paramInteger, array: true, required: true},
+	}},
+
+	"get_order_book":    {params: []restParam{{name: "limit", kind: paramInteger, def: 50}}},
+	"get_recent_trades": {params: []restParam{{name: "limit", kind: paramInteger, def: 50}}},
+	"get_trade_history": {params: []restParam{
+		{name: "start", kind: paramString, required: true},
+		{name: "end", kind: paramString, required: true},
+		{name: "limit", kind: paramInteger, def: 100},
+	}},
+	"get_market_history": {params: []restParam{
+		{name: "bucket_seconds", kind: paramInteger, required: true},
+		{name: "start", kind: paramString, required: true},
+		{name: "end", kind: paramString, required: true},
+	}},
+
+	"get_content": {params: []restParam{{name: "author", kind: paramString, required: true}, {name: "permlink", kind: paramString, required: true}},
+		example: `{"id": 1, "author": "bob", "permlink": "hello", "category": "hive", "title": "Hello", "body": "Hello, Hive.", "created": "2021-12-13T11:30:36", "last_update": "2021-12-13T11:30:36", "children": 0}`},
+	"get_content_replies": {params: []restParam{{name: "author", kind: paramString, required: true}, {name: "permlink", kind: paramString, required: true}}},
+	"get_active_votes":    {params: []restParam{{name: "author", kind: paramString, required: true}, {name: "permlink", kind: paramString, required: true}}},
+	"get_reblogged_by":    {params: []restParam{{name: "author", kind: paramString, required: true}, {name: "permlink", kind: paramString, required: true}}},
+	"get_discussion":      {params: []restParam{{name: "author", kind: paramString, required: true}, {name: "permlink", kind: paramString, required: true}}},
+	"get_state":           {params: []restParam{{name: "path", kind: paramString, def: "", desc: "A condenser page path, e.g. /trending or /@alice."}}},
+	"get_followers": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "start", kind: paramString, def: ""},
+		{name: "type", kind: paramString, def: "blog", enum: []string{"blog", "ignore"}},
+		{name: "limit", kind: paramInteger, def: 100},
+	}},
+	"get_following": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "start", kind: paramString, def: ""},
+		{name: "type", kind: paramString, def: "blog", enum: []string{"blog", "ignore"}},
+		{name: "limit", kind: paramInteger, def: 100},
+	}},
+	"get_blog": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "start_entry_id", kind: paramInteger, def: 0},
+		{name: "limit", kind: paramInteger, def: 20},
+	}},
+	"get_blog_entries": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "start_entry_id", kind: paramInteger, def: 0},
+		{name: "limit", kind: paramInteger, def: 20},
+	}},
+	"get_trending_tags": {params: []restParam{
+		{name: "start_tag", kind: paramString, def: ""},
+		{name: "limit", kind: paramInteger, def: 100},
+	}},
+	"get_replies_by_last_update": {params: []restParam{
+		{name: "start_author", kind: paramString, required: true},
+		{name: "start_permlink", kind: paramString, def: ""},
+		{name: "limit", kind: paramInteger, def: 20},
+	}},
+	"get_discussions_by_author_before_date": {params: []restParam{
+		{name: "author", kind: paramString, required: true},
+		{name: "start_permlink", kind: paramString, def: ""},
+		{name: "before_date", kind: paramString, def: "1970-01-01T00:00:00"},
+		{name: "limit", kind: paramInteger, def: 20},
+	}},
+
+	"get_discussions_by_trending":       {params: discussionQuery, query: true},
+	"get_discussions_by_hot":            {params: discussionQuery, query: true},
+	"get_discussions_by_promoted":       {params: discussionQuery, query: true},
+	"get_discussions_by_created":        {params: discussionQuery, query: true},
+	"get_discussions_by_blog":           {params: discussionQuery, query: true},
+	"get_discussions_by_feed":           {params: discussionQuery, query: true},
+	"get_discussions_by_comments":       {params: discussionQuery, query: true},
+	"get_post_discussions_by_payout":    {params: discussionQuery, query: true},
+	"get_comment_discussions_by_payout": {params: discussionQuery, query: true},
+}
+
+// Builds the positional params of a condenser_api method from its typed named params. Optional parameters without
+// a default are left off the end when not given, but must be given when a later parameter is.
+func condenserParams(sig condenserSignature, named map[string]interface{}, method string) ([]interface{}, error) {
+	if sig.query {
+		return []interface{}{named}, nil
+	}
+	last := -1
+	for i, p := range sig.params {
+		if _, ok := named[p.name]; ok {
+			last = i
+		}
+	}
+	params := make([]interface{}, 0, last+1)
+	for _, p := range sig.params[:last+1] {
+		v, ok := named[p.name]
+		if !ok {
+			return nil, newStatusError(http.StatusBadRequest, "Missing parameter "+strconv.Quote(p.name)+" for "+method+", needed by the parameters after it")
+		}
+		params = append(params, v)
+	}
+	return params, nil
+}
@@ -1,56 +1,84 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"math"
 	"net/http"
-	"net/url"
-	"strconv"
 	"time"
 
-	jsoniter "github.com/json-iterator/go"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
-// Provides a simple interface to the supply from get_dynamic_global_properties.
-func getTotalSupply(targetUrl string, supplyType string, w http.ResponseWriter) {
-	params := map[string]interface{}{}
-	reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "database_api" + "." + "get_dynamic_global_properties", "params": params}
-	status, resp := requestToResponse(ep2pool[targetUrl], reqmessage)
-	if status != http.StatusOK {
-		http.Error(w, http.StatusText(status), status)
+// Writes an error returned by an extension. Upstream errors are passed through as json, like the REST interface does.
+func writeExtensionError(w http.ResponseWriter, err error) {
+	var rerr *rpcError
+	if errors.As(err, &rerr) {
+		w.Header().Set("Content-Type", "application/json")
+		respj, _ := json.MarshalIndent(rerr, "", "  ")
+		w.Write(respj)
+		return
+	}
+	var serr *statusError
+	if errors.As(err, &serr) {
+		http.Error(w, serr.Error(), serr.status)
 		return
 	}
-	sup := (((resp["result"]).(map[string]interface{}))[supplyType]).(map[string]interface{})
-	realAmount := sup["amount"].(string)
+	log.Println("Extension error:", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// Provides a simple interface to the supply from get_dynamic_global_properties.
+func getTotalSupply(ctx context.Context, targetUrl string, supplyType string, w http.ResponseWriter) error {
+	dgp, err := currentHead(ctx, ep2pool[targetUrl])
+	if err != nil {
+		return err
+	}
+	var sup naiAsset
+	switch supplyType {
+	case "virtual_supply":
+		sup = dgp.VirtualSupply
+	case "current_supply":
+		sup = dgp.CurrentSupply
+	default:
+		return errors.New("unknown supply type " + supplyType)
+	}
+	realAmount := sup.Amount
+	if len(realAmount) <= 3 {
+		return newStatusError(http.StatusBadGateway, "Unexpected supply amount from upstream")
+	}
 	toWrite := realAmount[:len(realAmount)-3]
 	toWrite = toWrite + "."
 	toWrite = toWrite + realAmount[len(realAmount)-3:]
 	w.Write([]byte(toWrite))
+	return nil
 }
 
 // Retrives the block that occured at the given timestamp. Needs to do some searching for it.
-func getBlockByTime(targetUrl string, inputParams url.Values, w http.ResponseWriter, mark time.Time) {
-	if inputParams["timestamp"] == nil || len(inputParams["timestamp"]) != 1 {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-	status, btarget := getBlockByTimeHelper(ep2pool[targetUrl], inputParams["timestamp"][0])
-	if status != http.StatusOK {
-		http.Error(w, http.StatusText(status), status)
-		return
+func getBlockByTime(ctx context.Context, targetUrl string, inputParams map[string]interface{}, w http.ResponseWriter, mark time.Time) error {
+	timestamp, _ := inputParams["timestamp"].(string)
+	btarget, err := getBlockByTimeHelper(ctx, ep2pool[targetUrl], timestamp)
+	if err != nil {
+		return err
 	}
 
 	//log.Println("btarget", btarget, "\n")
 	params := map[string]interface{}{"block_num": btarget}
 	reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "block_api" + "." + "get_block", "params": params}
-	status, rresp := requestToResponse(ep2pool[targetUrl], reqmessage)
-	if status != http.StatusOK {
-		http.Error(w, http.StatusText(status), status)
-		return
+	// The block is passed through as is, so only its presence is typed.
+	var result struct {
+		Block map[string]interface{} `json:"block"`
+	}
+	if err := requestToResult(ctx, ep2pool[targetUrl], reqmessage, &result); err != nil {
+		return err
 	}
-	(((rresp["result"]).(map[string]interface{}))["block"]).(map[string]interface{})["block"] = btarget
+	if result.Block == nil {
+		return newStatusError(http.StatusNotFound, "")
+	}
+	result.Block["block"] = btarget
+	rresp := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "result": result}
 	// Finalize reply, convert back from json, and write.
 	w.Header().Set("Content-Type", "application/json")
 	respj, _ := json.MarshalIndent(rresp, "", "  ")
@@ -62,21 +90,20 @@ func getBlockByTime(targetUrl string, inputParams url.Values, w http.ResponseWri
 		jm, _ := jsonit.Marshal(reqmessage)
 		log.Println(elapsed, string(jm))
 	}
+	return nil
 }
 
 // Helper function for getBlockByTime. Does the actual searching.
-func getBlockByTimeHelper(jobp jobPool, reqtime string) (int, int) {
+func getBlockByTimeHelper(ctx context.Context, jobp jobPool, reqtime string) (int, error) {
 	tsInit := "2016-03-24T16:05:00"
-	layout := "2006-01-02T15:04:05"
-	t1, _ := time.Parse(layout, tsInit)
-	t2, err := time.Parse(layout, reqtime)
+	t1, _ := time.Parse(chainTimeLayout, tsInit)
+	t2, err := time.Parse(chainTimeLayout, reqtime)
 	if err != nil {
-		return http.StatusBadRequest, 0
+		return 0, newStatusError(http.StatusBadRequest, "")
 	}
 	diff := t2.Sub(t1)
 	bguess := int(diff.Seconds() / 3)
 	//log.Println("bguess: ", bguess)
-	params := map[string]interface{}{}
 	btarget := 0
 	if diff < 0 {
 		btarget = 1
@@ -85,34 +112,31 @@ func getBlockByTimeHelper(jobp jobPool, reqtime string) (int, int) {
 		bguess = 1
 	}
 
-	reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "database_api" + "." + "get_dynamic_global_properties", "params": params}
-	status, resp := requestToResponse(jobp, reqmessage)
-	if status != http.StatusOK {
-		return status, 0
+	dgp, err := currentHead(ctx, jobp)
+	if err != nil {
+		return 0, err
 	}
-	head, ok := (((resp["result"]).(map[string]interface{}))["time"]).(string)
-	headt, _ := time.Parse(layout, head)
-	if !ok {
-		return http.StatusBadRequest, 0
+	headt, err := time.Parse(chainTimeLayout, dgp.Time)
+	if err != nil {
+		return 0, newStatusError(http.StatusBadGateway, "Unexpected head time from upstream")
 	}
 
 	if t2.Sub(headt) > 0 {
-		jbt, _ := jsoniter.CastJsonNumber((((resp["result"]).(map[string]interface{}))["head_block_number"]))
-		btarget, _ = strconv.Atoi(jbt)
+		btarget = int(dgp.HeadBlockNumber)
 	}
 
 	bdeltaprev := 0
 	bconst := int(math.Pow(2, 23)) // for refinement
 	for btarget == 0 {
-		params = map[string]interface{}{"block_num": bguess}
-		reqmessage = map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "block_api" + "." + "get_block_header", "params": params}
+		params := map[string]interface{}{"block_num": bguess}
+		reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "block_api" + "." + "get_block_header", "params": params}
 
-		status, resp := requestToResponse(jobp, reqmessage)
-		if status != http.StatusOK {
-			return status, 0
+		var result blockHeaderResult
+		if err := requestToResult(ctx, jobp, reqmessage, &result); err != nil {
+			return 0, err
 		}
 
-		if (resp["result"]).(map[string]interface{})["header"] == nil { // too far
+		if result.Header == nil { // too far
 			bguess = bguess - bconst
 			bconst = int(bconst / 2)
 			if bconst == 0 {
@@ -121,12 +145,10 @@ func getBlockByTimeHelper(jobp jobPool, reqtime string) (int, int) {
 			}
 			continue
 		}
-		newts := (((resp["result"]).(map[string]interface{}))["header"]).(map[string]interface{})["timestamp"]
-		newtss, ok := newts.(string)
-		if !ok {
-			return http.StatusBadRequest, 0
+		t3, err := time.Parse(chainTimeLayout, result.Header.Timestamp)
+		if err != nil {
+			return 0, newStatusError(http.StatusBadGateway, "Unexpected block timestamp from upstream")
 		}
-		t3, _ := time.Parse(layout, newtss)
 		tdelta := t3.Sub(t2) // how far ahead we are
 		bdelta := int(tdelta.Seconds() / 3)
 		if bdelta == 0 {
@@ -140,37 +162,23 @@ func getBlockByTimeHelper(jobp jobPool, reqtime string) (int, int) {
 		}
 		bdeltaprev = bdelta
 	}
-	return http.StatusOK, btarget
+	return btarget, nil
 }
 
 // Returns the original body of a post, even if it has been edited. Uses the block by time helper function.
-func getOriginalBody(targetUrl string, fparams map[string]interface{}, w http.ResponseWriter, mark time.Time) {
+func getOriginalBody(ctx context.Context, targetUrl string, fparams map[string]interface{}, w http.ResponseWriter, mark time.Time) error {
 	reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "condenser_api" + "." + "get_content", "params": []interface{}{fparams["author"], fparams["permlink"]}}
-	status, resp := requestToResponse(ep2pool[targetUrl], reqmessage)
-	if status != http.StatusOK {
-		http.Error(w, http.StatusText(status), status)
-		return
+	var content discussion
+	if err := requestToResult(ctx, ep2pool[targetUrl], reqmessage, &content); err != nil {
+		return err
 	}
-	created := (((resp["result"]).(map[string]interface{}))["created"]).(string)
-	last_update, ok := (((resp["result"]).(map[string]interface{}))["last_update"]).(string)
 
-	if !ok {
-		// Finalize reply, convert back from json, and write.
-		w.Header().Set("Content-Type", "application/json")
-		respj, _ := json.MarshalIndent(resp, "", "  ")
-		w.Write(respj)
-		if debug {
-			elapsed := time.Since(mark)
-			delete(reqmessage, "id")
-			delete(reqmessage, "jsonrpc")
-			jm, _ := jsonit.Marshal(reqmessage)
-			log.Println(elapsed, string(jm))
-		}
-		return
+	if content.Created == "" || content.LastUpdate == "" {
+		return newStatusError(http.StatusNotFound, "")
 	}
 
-	oldbdy, _ := (((resp["result"]).(map[string]interface{}))["body"]).(string)
-	if created == last_update {
+	oldbdy := content.Body
+	if content.Created == content.LastUpdate {
 		respmessage := map[string]interface{}{"body": oldbdy, "edited": false}
 		// Finalize reply, convert back from json, and write.
 		w.Header().Set("Content-Type", "application/json")
@@ -183,49 +191,49 @@ func getOriginalBody(targetUrl string, fparams map[string]interface{}, w http.Re
 			jm, _ := jsonit.Marshal(reqmessage)
 			log.Println(elapsed, string(jm))
 		}
-		return
+		return nil
 	}
 
-	status, btarget := getBlockByTimeHelper(ep2pool[targetUrl], created)
-	if status != http.StatusOK {
-		http.Error(w, http.StatusText(status), status)
-		return
+	btarget, err := getBlockByTimeHelper(ctx, ep2pool[targetUrl], content.Created)
+	if err != nil {
+		return err
 	}
 
 	params := map[string]interface{}{"block_num": btarget + 1}
 	reqmessage = map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "block_api" + "." + "get_block", "params": params}
-	status, resp = requestToResponse(ep2pool[targetUrl], reqmessage)
-	if status != http.StatusOK {
-		http.Error(w, http.StatusText(status), status)
-		return
+	var result blockResult
+	if err := requestToResult(ctx, ep2pool[targetUrl], reqmessage, &result); err != nil {
+		return err
+	}
+	if result.Block == nil {
+		return newStatusError(http.StatusNotFound, "")
 	}
 
-	trxs := ((resp["result"].(map[string]interface{})["block"]).(map[string]interface{})["transactions"]).([]interface{})
-	for _, trx := range trxs {
-		rtrx, _ := (trx).(map[string]interface{})
-		ops := (rtrx["operations"]).([]interface{})
-		for _, op := range ops {
-			rop, _ := (op).(map[string]interface{})
-			if rop["type"] == "comment_operation" {
-				ropv := (rop["value"]).(map[string]interface{})
-				if ropv["author"] == fparams["author"] && ropv["permlink"] == fparams["permlink"] {
-					bdy, _ := ropv["body"].(string)
-					dmp := diffmatchpatch.New()
-					diffs := dmp.DiffMain(bdy, oldbdy, false)
-					respmessage := map[string]interface{}{"body": bdy, "edited": true, "diff_to_latest": dmp.DiffToDelta(diffs)}
-					// Finalize reply, convert back from json, and write.
-					w.Header().Set("Content-Type", "application/json")
-					respj, _ := json.MarshalIndent(respmessage, "", "  ")
-					w.Write(respj)
-					if debug {
-						elapsed := time.Since(mark)
-						delete(reqmessage, "id")
-						delete(reqmessage, "jsonrpc")
-						jm, _ := jsonit.Marshal(reqmessage)
-						log.Println(elapsed, string(jm))
-					}
-					return
+	for _, trx := range result.Block.Transactions {
+		for _, op := range trx.Operations {
+			if op.Type != "comment_operation" {
+				continue
+			}
+			var ropv commentOperation
+			if err := jsonit.Unmarshal(op.Value, &ropv); err != nil {
+				continue
+			}
+			if ropv.Author == fparams["author"] && ropv.Permlink == fparams["permlink"] {
+				dmp := diffmatchpatch.New()
+				diffs := dmp.DiffMain(ropv.Body, oldbdy, false)
+				respmessage := map[string]interface{}{"body": ropv.Body, "edited": true, "diff_to_latest": dmp.DiffToDelta(diffs)}
+				// Finalize reply, convert back from json, and write.
+				w.Header().Set("Content-Type", "application/json")
+				respj, _ := json.MarshalIndent(respmessage, "", "  ")
+				w.Write(respj)
+				if debug {
+					elapsed := time.Since(mark)
+					delete(reqmessage, "id")
+					delete(reqmessage, "jsonrpc")
+					jm, _ := jsonit.Marshal(reqmessage)
+					log.Println(elapsed, string(jm))
 				}
+				return nil
 			}
 		}
 	}
@@ -235,4 +243,5 @@ func getOriginalBody(targetUrl string, fparams map[string]interface{}, w http.Re
 	w.Header().Set("Content-Type", "application/json")
 	respj, _ := json.MarshalIndent(respmessage, "", "  ")
 	w.Write(respj)
+	return nil
 }
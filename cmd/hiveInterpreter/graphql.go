@@ -0,0 +1,1409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds on a GraphQL request, so that one cannot make more upstream calls than a page of REST calls would.
+const (
+	gqlMaxBody  = 64 << 10
+	gqlMaxDepth = 10
+	gqlMaxCost  = 5000
+	// Field selections a query may expand to, once its fragments are spread.
+	gqlMaxSelections = 2000
+	// Distinct upstream calls a request may make.
+	gqlMaxCalls = 200
+	// Upstream calls a request makes at once.
+	gqlConcurrency = 8
+)
+
+// Serves GraphQL queries over the routed APIs, as a GET with the query in the url or a POST of a json request.
+// A GET without a query gives the schema.
+func doHandleGraphQL(w http.ResponseWriter, r *http.Request) {
+	mark := time.Now()
+	var req struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if req.Query == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, gqlSDL())
+			return
+		}
+		if v := q.Get("variables"); v != "" {
+			if err := jsonit.UnmarshalFromString(v, &req.Variables); err != nil {
+				writeGraphQLError(w, &gqlError{Message: "Variables must be a json object"})
+				return
+			}
+		}
+	case http.MethodPost:
+		b, err := io.ReadAll(io.LimitReader(r.Body, gqlMaxBody+1))
+		r.Body.Close()
+		if err != nil || len(b) > gqlMaxBody {
+			writeGraphQLError(w, &gqlError{Message: "Request is too large, at most " + strconv.Itoa(gqlMaxBody) + " bytes"})
+			return
+		}
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/graphql" {
+			req.Query = string(b)
+		} else if err := jsonit.Unmarshal(b, &req); err != nil {
+			writeGraphQLError(w, &gqlError{Message: "Request must be a json object with a query"})
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Query == "" {
+		writeGraphQLError(w, &gqlError{Message: "No query given"})
+		return
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		writeGraphQLError(w, err)
+		return
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		writeGraphQLError(w, err)
+		return
+	}
+	vars, err := op.variables(req.Variables)
+	if err != nil {
+		writeGraphQLError(w, err)
+		return
+	}
+	pl := &gqlPlanner{doc: doc, op: op, vars: vars}
+	plans, cost, err := pl.plan(gqlQuery, op.sel, 0)
+	if err != nil {
+		writeGraphQLError(w, err)
+		return
+	}
+
+	gr := &gqlRequest{ctx: r.Context(), client: clientIdentity(r), items: map[*gqlBatch]map[string]*gqlLoad{}, calls: map[string]*gqlLoad{}}
+	data := gr.execute(plans)
+	var out bytes.Buffer
+	out.WriteString(`{"data":`)
+	writeGQLValue(&out, data)
+	if len(gr.errors) > 0 {
+		errs, _ := jsonit.Marshal(gr.errors)
+		out.WriteString(`,"errors":`)
+		out.Write(errs)
+	}
+	out.WriteByte('}')
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out.Bytes())
+
+	if debug {
+		log.Println(time.Since(mark), "graphql cost", cost, "calls", gr.made)
+	}
+}
+
+// An error in the GraphQL response shape. Errors of the request as a whole have no path.
+type gqlError struct {
+	Message   string        `json:"message"`
+	Locations []gqlLocation `json:"locations,omitempty"`
+	Path      []interface{} `json:"path,omitempty"`
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (e *gqlError) Error() string {
+	return e.Message
+}
+
+// Fails a request that cannot be run, with a 400.
+func writeGraphQLError(w http.ResponseWriter, err error) {
+	gerr, ok := err.(*gqlError)
+	if !ok {
+		gerr = &gqlError{Message: err.Error()}
+	}
+	b, _ := jsonit.Marshal(map[string]interface{}{"errors": []*gqlError{gerr}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(b)
+}
+
+// The executable definitions of a GraphQL document.
+type gqlDocument struct {
+	ops       []*gqlOp
+	fragments map[string]*gqlFragment
+}
+
+type gqlOp struct {
+	kind string // query, mutation or subscription
+	name string
+	vars []gqlVarDef
+	sel  []gqlSelection
+}
+
+type gqlVarDef struct {
+	name   string
+	typ    *gqlTypeRef
+	def    interface{}
+	hasDef bool
+}
+
+type gqlFragment struct {
+	on  string
+	sel []gqlSelection
+}
+
+// A field, or a fragment spread (spread is set), or an inline fragment (fragment is set).
+type gqlSelection struct {
+	alias, name string
+	args        []gqlArg
+	dirs        []gqlArg // Directives, with their if argument
+	sel         []gqlSelection
+	spread      string
+	fragment    bool
+	on          string // Type condition of an inline fragment
+	loc         gqlLocation
+}
+
+type gqlArg struct {
+	name  string
+	value interface{}
+}
+
+// Values in a document that are not json values.
+type (
+	gqlVar         string
+	gqlEnum        string
+	gqlInputObject []gqlArg
+)
+
+// A type, as written: a named type or a list, either possibly non-null.
+type gqlTypeRef struct {
+	name    string
+	list    *gqlTypeRef
+	nonNull bool
+}
+
+func (t *gqlTypeRef) String() string {
+	s := t.name
+	if t.list != nil {
+		s = "[" + t.list.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+// Parses the type of a schema field or argument.
+func gqlParseType(s string) *gqlTypeRef {
+	p := &gqlParser{src: s}
+	p.next()
+	return p.typeRef()
+}
+
+// The operation to run: the one named, or the only one.
+func (doc *gqlDocument) operation(name string) (*gqlOp, error) {
+	var op *gqlOp
+	if name == "" {
+		if len(doc.ops) > 1 {
+			return nil, &gqlError{Message: "Must give operationName to pick one of the operations"}
+		}
+		op = doc.ops[0]
+	}
+	for _, o := range doc.ops {
+		if name != "" && o.name == name {
+			op = o
+		}
+	}
+	if op == nil {
+		return nil, &gqlError{Message: "Unknown operation " + strconv.Quote(name)}
+	}
+	if op.kind != "query" {
+		return nil, &gqlError{Message: "Only queries are supported"}
+	}
+	return op, nil
+}
+
+// The values of an operation's variables, from those given and the defaults.
+func (op *gqlOp) variables(given map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{}, len(op.vars))
+	for _, v := range op.vars {
+		if !gqlInputTypes[gqlNamedType(v.typ)] {
+			return nil, &gqlError{Message: "Variable \"$" + v.name + "\" has unknown type " + strconv.Quote(v.typ.String())}
+		}
+		value, ok := given[v.name]
+		if !ok {
+			if v.hasDef {
+				value, _ = gqlResolve(v.def, nil)
+			} else if v.typ.nonNull {
+				return nil, &gqlError{Message: "Variable \"$" + v.name + "\" of required type " + strconv.Quote(v.typ.String()) + " was not given"}
+			} else {
+				continue
+			}
+		}
+		c, err := gqlCoerce(v.typ, value)
+		if err != nil {
+			return nil, &gqlError{Message: "Variable \"$" + v.name + "\": " + err.Error()}
+		}
+		vars[v.name] = c
+	}
+	return vars, nil
+}
+
+// Input types, which variables and arguments may have.
+var gqlInputTypes = map[string]bool{"Int": true, "Float": true, "String": true, "ID": true, "Boolean": true, "JSON": true}
+
+func gqlNamedType(t *gqlTypeRef) string {
+	for t.list != nil {
+		t = t.list
+	}
+	return t.name
+}
+
+// Coerces an input value to a type. Single values are taken as lists of one.
+func gqlCoerce(t *gqlTypeRef, v interface{}) (interface{}, error) {
+	if v == nil {
+		if t.nonNull {
+			return nil, errors.New("must not be null")
+		}
+		return nil, nil
+	}
+	if t.list != nil {
+		items, ok := v.([]interface{})
+		if !ok {
+			items = []interface{}{v}
+		}
+		out := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			c, err := gqlCoerce(t.list, item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, c)
+		}
+		return out, nil
+	}
+	switch t.name {
+	case "Int":
+		if n, ok := v.(json.Number); ok {
+			if _, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+				return n, nil
+			}
+		}
+		return nil, errors.New("must be an Int")
+	case "Float":
+		if n, ok := v.(json.Number); ok {
+			return n, nil
+		}
+		return nil, errors.New("must be a Float")
+	case "String", "ID":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		if n, ok := v.(json.Number); ok && t.name == "ID" {
+			return string(n), nil
+		}
+		return nil, errors.New("must be a " + t.name)
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		return nil, errors.New("must be a Boolean")
+	case "JSON":
+		return v, nil
+	}
+	return nil, errors.New("has unknown type " + strconv.Quote(t.name))
+}
+
+// The value of a document value, with its variables. A variable that was not given is not present.
+func gqlResolve(v interface{}, vars map[string]interface{}) (interface{}, bool) {
+	switch x := v.(type) {
+	case gqlVar:
+		value, ok := vars[string(x)]
+		return value, ok
+	case gqlEnum:
+		return string(x), true
+	case []interface{}:
+		out := make([]interface{}, 0, len(x))
+		for _, item := range x {
+			value, _ := gqlResolve(item, vars)
+			out = append(out, value)
+		}
+		return out, true
+	case gqlInputObject:
+		out := make(map[string]interface{}, len(x))
+		for _, f := range x {
+			if value, ok := gqlResolve(f.value, vars); ok {
+				out[f.name] = value
+			}
+		}
+		return out, true
+	}
+	return v, true
+}
+
+// Parses GraphQL documents. Errors are raised as a *gqlError panic, and returned by parseGraphQL.
+type gqlParser struct {
+	src  string
+	pos  int // Start and end of the current token.
+	end  int
+	kind byte
+	val  string
+	// The line of the last location taken, and the offset it starts at, so that locations are found without
+	// rescanning the document.
+	line, lineStart, scanned int
+}
+
+// Token kinds.
+const (
+	gqlEOF    = 0
+	gqlName   = 'n'
+	gqlInt    = 'i'
+	gqlFloat  = 'f'
+	gqlString = 's'
+	gqlPunct  = 'p'
+)
+
+func parseGraphQL(src string) (doc *gqlDocument, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			perr, ok := e.(*gqlError)
+			if !ok {
+				panic(e)
+			}
+			doc, err = nil, perr
+		}
+	}()
+	p := &gqlParser{src: src}
+	p.next()
+	doc = &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.kind != gqlEOF {
+		p.definition(doc)
+	}
+	if len(doc.ops) == 0 {
+		return nil, &gqlError{Message: "No operation given"}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) location(pos int) gqlLocation {
+	if pos < p.scanned {
+		p.line, p.lineStart, p.scanned = 0, 0, 0
+	}
+	for i := p.scanned; i < pos; i++ {
+		if p.src[i] == '\n' {
+			p.line, p.lineStart = p.line+1, i+1
+		}
+	}
+	p.scanned = pos
+	return gqlLocation{Line: p.line + 1, Column: pos - p.lineStart + 1}
+}
+
+func (p *gqlParser) fail(msg string) {
+	panic(&gqlError{Message: "Syntax error: " + msg, Locations: []gqlLocation{p.location(p.pos)}})
+}
+
+func (p *gqlParser) unexpected() {
+	if p.kind == gqlEOF {
+		p.fail("unexpected end of document")
+	}
+	p.fail("unexpected " + strconv.Quote(p.src[p.pos:p.end]))
+}
+
+func (p *gqlParser) isPunct(s string) bool {
+	return p.kind == gqlPunct && p.val == s
+}
+
+func (p *gqlParser) expectPunct(s string) {
+	if !p.isPunct(s) {
+		p.unexpected()
+	}
+	p.next()
+}
+
+func (p *gqlParser) expectName() string {
+	if p.kind != gqlName {
+		p.unexpected()
+	}
+	name := p.val
+	p.next()
+	return name
+}
+
+// Reads the next token, skipping whitespace, commas and comments.
+func (p *gqlParser) next() {
+	src := p.src
+	i := p.end
+	for i < len(src) {
+		c := src[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			i++
+		} else if strings.HasPrefix(src[i:], "\ufeff") {
+			i += 3
+		} else if c == '#' {
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		} else {
+			break
+		}
+	}
+	p.pos, p.end = i, i
+	if i == len(src) {
+		p.kind, p.val = gqlEOF, ""
+		return
+	}
+	c := src[i]
+	switch {
+	case strings.HasPrefix(src[i:], "..."):
+		p.kind, p.val, p.end = gqlPunct, "...", i+3
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		p.kind, p.val, p.end = gqlPunct, src[i:i+1], i+1
+	case c == '_' || gqlIsLetter(c):
+		j := i + 1
+		for j < len(src) && (src[j] == '_' || gqlIsLetter(src[j]) || gqlIsDigit(src[j])) {
+			j++
+		}
+		p.kind, p.val, p.end = gqlName, src[i:j], j
+	case c == '-' || gqlIsDigit(c):
+		p.number()
+	case c == '"':
+		p.string()
+	default:
+		p.fail("unexpected character " + strconv.QuoteRune(rune(c)))
+	}
+}
+
+func gqlIsLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func gqlIsDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *gqlParser) number() {
+	src := p.src
+	j := p.pos
+	digits := func() {
+		start := j
+		for j < len(src) && gqlIsDigit(src[j]) {
+			j++
+		}
+		if j == start {
+			p.end = j
+			p.fail("bad number")
+		}
+	}
+	if src[j] == '-' {
+		j++
+	}
+	digits()
+	p.kind = gqlInt
+	if j < len(src) && src[j] == '.' {
+		j++
+		digits()
+		p.kind = gqlFloat
+	}
+	if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+		j++
+		if j < len(src) && (src[j] == '+' || src[j] == '-') {
+			j++
+		}
+		digits()
+		p.kind = gqlFloat
+	}
+	if j < len(src) && (src[j] == '.' || src[j] == '_' || gqlIsLetter(src[j])) {
+		p.fail("bad number")
+	}
+	p.val, p.end = src[p.pos:j], j
+}
+
+func (p *gqlParser) string() {
+	src := p.src
+	if strings.HasPrefix(src[p.pos:], `"""`) {
+		j := p.pos + 3
+		for {
+			if j >= len(src) {
+				p.fail("unterminated string")
+			}
+			if strings.HasPrefix(src[j:], `\"""`) {
+				j += 4
+				continue
+			}
+			if strings.HasPrefix(src[j:], `"""`) {
+				break
+			}
+			j++
+		}
+		p.kind, p.val, p.end = gqlString, gqlBlockString(strings.ReplaceAll(src[p.pos+3:j], `\"""`, `"""`)), j+3
+		return
+	}
+	j := p.pos + 1
+	for {
+		if j >= len(src) || src[j] == '\n' || src[j] == '\r' {
+			p.fail("unterminated string")
+		}
+		if src[j] == '\\' {
+			j += 2
+			continue
+		}
+		if src[j] == '"' {
+			break
+		}
+		j++
+	}
+	// The escapes of GraphQL strings are those of json.
+	var s string
+	if err := json.Unmarshal([]byte(src[p.pos:j+1]), &s); err != nil {
+		p.fail("bad string")
+	}
+	p.kind, p.val, p.end = gqlString, s, j+1
+}
+
+// The value of a block string: its lines without their common indentation, or blank lines around them.
+func gqlBlockString(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		} else {
+			lines[i] = ""
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *gqlParser) definition(doc *gqlDocument) {
+	if p.isPunct("{") {
+		doc.ops = append(doc.ops, &gqlOp{kind: "query", sel: p.selectionSet()})
+		return
+	}
+	pos := p.pos
+	switch kind := p.expectName(); kind {
+	case "query", "mutation", "subscription":
+		op := &gqlOp{kind: kind}
+		if p.kind == gqlName {
+			op.name = p.expectName()
+		}
+		if p.isPunct("(") {
+			op.vars = p.variableDefinitions()
+		}
+		p.directives()
+		op.sel = p.selectionSet()
+		doc.ops = append(doc.ops, op)
+	case "fragment":
+		name := p.expectName()
+		if name == "on" {
+			p.fail("a fragment cannot be named on")
+		}
+		if p.expectName() != "on" {
+			p.fail("expected on after the fragment name")
+		}
+		f := &gqlFragment{on: p.expectName()}
+		p.directives()
+		f.sel = p.selectionSet()
+		if _, ok := doc.fragments[name]; ok {
+			p.pos = pos
+			p.fail("there can be only one fragment named " + strconv.Quote(name))
+		}
+		doc.fragments[name] = f
+	default:
+		p.pos = pos
+		p.fail("unexpected " + strconv.Quote(kind) + ", expected a query or fragment")
+	}
+}
+
+func (p *gqlParser) variableDefinitions() []gqlVarDef {
+	var defs []gqlVarDef
+	p.expectPunct("(")
+	for !p.isPunct(")") {
+		p.expectPunct("$")
+		v := gqlVarDef{name: p.expectName()}
+		p.expectPunct(":")
+		v.typ = p.typeRef()
+		if p.isPunct("=") {
+			p.next()
+			v.def, v.hasDef = p.value(true), true
+		}
+		p.directives()
+		defs = append(defs, v)
+	}
+	p.next()
+	return defs
+}
+
+func (p *gqlParser) typeRef() *gqlTypeRef {
+	t := &gqlTypeRef{}
+	if p.isPunct("[") {
+		p.next()
+		t.list = p.typeRef()
+		p.expectPunct("]")
+	} else {
+		t.name = p.expectName()
+	}
+	if p.isPunct("!") {
+		p.next()
+		t.nonNull = true
+	}
+	return t
+}
+
+func (p *gqlParser) selectionSet() []gqlSelection {
+	p.expectPunct("{")
+	sels := []gqlSelection{}
+	for !p.isPunct("}") {
+		sels = append(sels, p.selection())
+	}
+	if len(sels) == 0 {
+		p.fail("empty selection set")
+	}
+	p.next()
+	return sels
+}
+
+func (p *gqlParser) selection() gqlSelection {
+	s := gqlSelection{loc: p.location(p.pos)}
+	if p.isPunct("...") {
+		p.next()
+		if p.kind == gqlName && p.val != "on" {
+			s.spread = p.expectName()
+			s.dirs = p.directives()
+			return s
+		}
+		s.fragment = true
+		if p.kind == gqlName {
+			p.next()
+			s.on = p.expectName()
+		}
+		s.dirs = p.directives()
+		s.sel = p.selectionSet()
+		return s
+	}
+	s.name = p.expectName()
+	if p.isPunct(":") {
+		p.next()
+		s.alias, s.name = s.name, p.expectName()
+	}
+	if p.isPunct("(") {
+		s.args = p.arguments(false)
+	}
+	s.dirs = p.directives()
+	if p.isPunct("{") {
+		s.sel = p.selectionSet()
+	}
+	return s
+}
+
+func (p *gqlParser) arguments(isConst bool) []gqlArg {
+	var args []gqlArg
+	p.expectPunct("(")
+	for !p.isPunct(")") {
+		name := p.expectName()
+		p.expectPunct(":")
+		args = append(args, gqlArg{name: name, value: p.value(isConst)})
+	}
+	if len(args) == 0 {
+		p.fail("empty arguments")
+	}
+	p.next()
+	return args
+}
+
+// Directives, each given as an argument named by the directive and holding the directive's arguments.
+func (p *gqlParser) directives() []gqlArg {
+	var dirs []gqlArg
+	for p.isPunct("@") {
+		p.next()
+		d := gqlArg{name: p.expectName()}
+		if p.isPunct("(") {
+			d.value = p.arguments(false)
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs
+}
+
+func (p *gqlParser) value(isConst bool) interface{} {
+	switch p.kind {
+	case gqlInt, gqlFloat:
+		v := json.Number(p.val)
+		p.next()
+		return v
+	case gqlString:
+		v := p.val
+		p.next()
+		return v
+	case gqlName:
+		var v interface{}
+		switch p.val {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = gqlEnum(p.val)
+		}
+		p.next()
+		return v
+	case gqlPunct:
+		switch p.val {
+		case "$":
+			if isConst {
+				p.fail("a variable cannot be used in a constant value")
+			}
+			p.next()
+			return gqlVar(p.expectName())
+		case "[":
+			p.next()
+			list := []interface{}{}
+			for !p.isPunct("]") {
+				list = append(list, p.value(isConst))
+			}
+			p.next()
+			return list
+		case "{":
+			p.next()
+			obj := gqlInputObject{}
+			for !p.isPunct("}") {
+				name := p.expectName()
+				p.expectPunct(":")
+				obj = append(obj, gqlArg{name: name, value: p.value(isConst)})
+			}
+			p.next()
+			return obj
+		}
+	}
+	p.unexpected()
+	return nil
+}
+
+// An object type of the schema.
+type gqlType struct {
+	name   string
+	desc   string
+	fields []gqlField
+}
+
+type gqlField struct {
+	name string
+	typ  string
+	args []gqlFieldArg
+	desc string
+	// Estimated items of a list field, for the cost of a query. Nil for lists of unknown size.
+	size func(args map[string]interface{}) int
+	// Gives the field of an object. Nil takes the member of the object with the field's name.
+	resolve func(gr *gqlRequest, obj gqlObject, args map[string]interface{}) gqlThunk
+}
+
+type gqlFieldArg struct {
+	name string
+	typ  string
+	def  interface{}
+}
+
+// Items assumed of a list field of unknown size.
+const gqlListSize = 20
+
+var gqlTypenameField = gqlField{name: "__typename", typ: "String!"}
+
+func (t *gqlType) field(name string) *gqlField {
+	if name == gqlTypenameField.name {
+		return &gqlTypenameField
+	}
+	for i := range t.fields {
+		if t.fields[i].name == name {
+			return &t.fields[i]
+		}
+	}
+	return nil
+}
+
+// What to resolve of a field of a query: its response key, field, arguments and, for object fields, the fields of
+// its objects.
+type gqlPlan struct {
+	key   string
+	field *gqlField
+	args  map[string]interface{}
+	typ   *gqlType
+	sub   []*gqlPlan
+}
+
+// Checks a query against the schema, and plans its execution. The cost of a query is the objects and values it may
+// resolve, with lists taken to have as many items as they ask for, each charged.
+type gqlPlanner struct {
+	doc  *gqlDocument
+	op   *gqlOp
+	vars map[string]interface{}
+	// Field selections collected so far.
+	selections int
+}
+
+func (pl *gqlPlanner) plan(t *gqlType, sels []gqlSelection, depth int) ([]*gqlPlan, int, error) {
+	var keys []string
+	fields := make(map[string][]*gqlSelection)
+	if err := pl.collect(t, sels, &keys, fields, map[string]bool{}); err != nil {
+		return nil, 0, err
+	}
+
+	plans := make([]*gqlPlan, 0, len(keys))
+	cost := 0
+	for _, key := range keys {
+		group := fields[key]
+		s := group[0]
+		for _, o := range group[1:] {
+			if o.name != s.name {
+				return nil, 0, &gqlError{Message: "Fields " + strconv.Quote(key) + " conflict, as " + s.name + " and " + o.name + " are different fields",
+					Locations: []gqlLocation{s.loc, o.loc}}
+			}
+		}
+		f := t.field(s.name)
+		if f == nil {
+			return nil, 0, &gqlError{Message: "Cannot query field " + strconv.Quote(s.name) + " on type " + strconv.Quote(t.name), Locations: []gqlLocation{s.loc}}
+		}
+		args, err := pl.arguments(t, f, s)
+		if err != nil {
+			return nil, 0, err
+		}
+		plan := &gqlPlan{key: key, field: f, args: args}
+		plans = append(plans, plan)
+
+		ftyp := gqlParseType(f.typ)
+		var sub []gqlSelection
+		for _, g := range group {
+			sub = append(sub, g.sel...)
+		}
+		plan.typ = gqlTypeNamed(gqlNamedType(ftyp))
+		if plan.typ == nil {
+			if sub != nil {
+				return nil, 0, &gqlError{Message: "Field " + strconv.Quote(s.name) + " of type " + strconv.Quote(f.typ) + " cannot have a selection", Locations: []gqlLocation{s.loc}}
+			}
+			continue
+		}
+		if sub == nil {
+			return nil, 0, &gqlError{Message: "Field " + strconv.Quote(s.name) + " of type " + strconv.Quote(f.typ) + " must have a selection of subfields", Locations: []gqlLocation{s.loc}}
+		}
+		if depth == gqlMaxDepth {
+			return nil, 0, &gqlError{Message: "Query is nested too deeply, at most " + strconv.Itoa(gqlMaxDepth) + " levels", Locations: []gqlLocation{s.loc}}
+		}
+		var subCost int
+		if plan.sub, subCost, err = pl.plan(plan.typ, sub, depth+1); err != nil {
+			return nil, 0, err
+		}
+		n := 1
+		if ftyp.list != nil {
+			n = gqlListSize
+			if f.size != nil {
+				n = f.size(args)
+			}
+		}
+		// Costs are kept from growing past what can be compared.
+		if n > gqlMaxCost {
+			n = gqlMaxCost
+		}
+		if cost += n * (1 + subCost); cost > gqlMaxCost {
+			return nil, 0, &gqlError{Message: "Query is too costly, at most " + strconv.Itoa(gqlMaxCost) + " objects may be resolved", Locations: []gqlLocation{s.loc}}
+		}
+	}
+	return plans, cost, nil
+}
+
+// Collects the fields a selection set gives of an object type, by response key in order. Each fragment is spread
+// once: spread has the fragments spread so far, true while they are being expanded.
+func (pl *gqlPlanner) collect(t *gqlType, sels []gqlSelection, keys *[]string, fields map[string][]*gqlSelection, spread map[string]bool) error {
+	for i := range sels {
+		s := &sels[i]
+		include, err := pl.included(s)
+		if err != nil {
+			return err
+		}
+		if !include {
+			continue
+		}
+		switch {
+		case s.spread != "":
+			f, ok := pl.doc.fragments[s.spread]
+			if !ok {
+				return &gqlError{Message: "Unknown fragment " + strconv.Quote(s.spread), Locations: []gqlLocation{s.loc}}
+			}
+			if expanding, ok := spread[s.spread]; ok {
+				if expanding {
+					return &gqlError{Message: "Fragment " + strconv.Quote(s.spread) + " spreads itself", Locations: []gqlLocation{s.loc}}
+				}
+				continue
+			}
+			if gqlTypeNamed(f.on) == nil {
+				return &gqlError{Message: "Unknown type " + strconv.Quote(f.on), Locations: []gqlLocation{s.loc}}
+			}
+			if f.on != t.name {
+				continue
+			}
+			spread[s.spread] = true
+			err = pl.collect(t, f.sel, keys, fields, spread)
+			spread[s.spread] = false
+		case s.fragment:
+			if s.on != "" && gqlTypeNamed(s.on) == nil {
+				return &gqlError{Message: "Unknown type " + strconv.Quote(s.on), Locations: []gqlLocation{s.loc}}
+			}
+			if s.on != "" && s.on != t.name {
+				continue
+			}
+			err = pl.collect(t, s.sel, keys, fields, spread)
+		default:
+			if pl.selections++; pl.selections > gqlMaxSelections {
+				return &gqlError{Message: "Query is too large, at most " + strconv.Itoa(gqlMaxSelections) + " fields may be selected", Locations: []gqlLocation{s.loc}}
+			}
+			key := s.alias
+			if key == "" {
+				key = s.name
+			}
+			if _, ok := fields[key]; !ok {
+				*keys = append(*keys, key)
+			}
+			fields[key] = append(fields[key], s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether a selection is included, by its @skip and @include directives.
+func (pl *gqlPlanner) included(s *gqlSelection) (bool, error) {
+	for _, d := range s.dirs {
+		if d.name != "skip" && d.name != "include" {
+			return false, &gqlError{Message: "Unknown directive \"@" + d.name + "\"", Locations: []gqlLocation{s.loc}}
+		}
+		args, _ := d.value.([]gqlArg)
+		var cond interface{}
+		for _, a := range args {
+			if a.name == "if" {
+				cond, _ = pl.resolve(a.value)
+			}
+		}
+		b, ok := cond.(bool)
+		if !ok {
+			return false, &gqlError{Message: "Directive \"@" + d.name + "\" needs a Boolean if argument", Locations: []gqlLocation{s.loc}}
+		}
+		if b == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (pl *gqlPlanner) resolve(v interface{}) (interface{}, bool) {
+	return gqlResolve(v, pl.vars)
+}
+
+// The arguments of a field, checked and coerced by their types, with their defaults.
+func (pl *gqlPlanner) arguments(t *gqlType, f *gqlField, s *gqlSelection) (map[string]interface{}, error) {
+	fail := func(msg string) error {
+		return &gqlError{Message: msg, Locations: []gqlLocation{s.loc}}
+	}
+	given := make(map[string]interface{}, len(s.args))
+	for _, a := range s.args {
+		known := false
+		for _, fa := range f.args {
+			known = known || fa.name == a.name
+		}
+		if !known {
+			return nil, fail("Unknown argument " + strconv.Quote(a.name) + " on field " + strconv.Quote(t.name+"."+f.name))
+		}
+		if err := pl.defined(a.value); err != nil {
+			return nil, fail(err.Error())
+		}
+		given[a.name] = a.value
+	}
+
+	args := make(map[string]interface{}, len(f.args))
+	for _, fa := range f.args {
+		typ := gqlParseType(fa.typ)
+		raw, ok := given[fa.name]
+		var value interface{}
+		if ok {
+			value, ok = pl.resolve(raw)
+		}
+		if !ok {
+			if fa.def != nil {
+				args[fa.name] = fa.def
+			} else if typ.nonNull {
+				return nil, fail("Argument " + strconv.Quote(fa.name) + " of " + strconv.Quote(t.name+"."+f.name) + " is required")
+			}
+			continue
+		}
+		c, err := gqlCoerce(typ, value)
+		if err != nil {
+			return nil, fail("Argument " + strconv.Quote(fa.name) + " of " + strconv.Quote(t.name+"."+f.name) + " " + err.Error())
+		}
+		args[fa.name] = c
+	}
+	return args, nil
+}
+
+// Checks that the variables a value uses are defined by the operation.
+func (pl *gqlPlanner) defined(v interface{}) error {
+	switch x := v.(type) {
+	case gqlVar:
+		for _, d := range pl.op.vars {
+			if d.name == string(x) {
+				return nil
+			}
+		}
+		return errors.New("Variable \"$" + string(x) + "\" is not defined")
+	case []interface{}:
+		for _, item := range x {
+			if err := pl.defined(item); err != nil {
+				return err
+			}
+		}
+	case gqlInputObject:
+		for _, f := range x {
+			if err := pl.defined(f.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// An object as the APIs give it, with any members the schema adds.
+type gqlObject map[string]json.RawMessage
+
+// Gives a field's value once the loads it wanted are done: json for leaf fields, and for object fields a gqlObject,
+// []gqlObject or nil.
+type gqlThunk func() (interface{}, error)
+
+// The upstream calls of a GraphQL request. Loads are wanted while resolving a level of the query, then made together
+// when it is done, so that the same call is made once and items of a batch are had in as few calls as can be.
+type gqlRequest struct {
+	ctx    context.Context
+	client string
+	items  map[*gqlBatch]map[string]*gqlLoad
+	calls  map[string]*gqlLoad
+	// Loads wanted since the last flush.
+	pending []*gqlLoad
+	made    int
+	errors  []*gqlError
+}
+
+type gqlLoad struct {
+	// A call, or an item of a batch.
+	method string
+	params interface{}
+	batch  *gqlBatch
+	key    string
+
+	result json.RawMessage
+	err    error
+}
+
+// Items that can be had together, such as accounts by name.
+type gqlBatch struct {
+	// Splits the keys of items wanted into those of each call.
+	group func(keys []string) [][]string
+	// Gives items by key. Items that do not exist are left out.
+	fetch func(gr *gqlRequest, keys []string) (map[string]json.RawMessage, error)
+}
+
+// Wants an item of a batch.
+func (gr *gqlRequest) item(b *gqlBatch, key string) *gqlLoad {
+	byKey, ok := gr.items[b]
+	if !ok {
+		byKey = make(map[string]*gqlLoad)
+		gr.items[b] = byKey
+	}
+	if l, ok := byKey[key]; ok {
+		return l
+	}
+	l := &gqlLoad{batch: b, key: key}
+	byKey[key] = l
+	gr.pending = append(gr.pending, l)
+	return l
+}
+
+// Wants the result of a call.
+func (gr *gqlRequest) call(method string, params interface{}) *gqlLoad {
+	b, _ := jsonit.Marshal(params)
+	key := method + string(b)
+	if l, ok := gr.calls[key]; ok {
+		return l
+	}
+	l := &gqlLoad{method: method, params: params}
+	gr.calls[key] = l
+	gr.pending = append(gr.pending, l)
+	return l
+}
+
+// Makes a call through the usual routing and cache.
+func (gr *gqlRequest) fetch(method string, params interface{}) (json.RawMessage, error) {
+	_, result, err := routedCall(gr.ctx, gr.client, method, params)
+	return result, err
+}
+
+// Makes the loads wanted since the last flush, a few calls at a time. Loads past the calls a request may make fail.
+func (gr *gqlRequest) flush() {
+	type job struct {
+		run   func()
+		loads []*gqlLoad
+	}
+	var jobs []job
+	batches := make(map[*gqlBatch]map[string]*gqlLoad)
+	var order []*gqlBatch
+	for _, l := range gr.pending {
+		if l.batch == nil {
+			jobs = append(jobs, job{func() { l.result, l.err = gr.fetch(l.method, l.params) }, []*gqlLoad{l}})
+			continue
+		}
+		if _, ok := batches[l.batch]; !ok {
+			batches[l.batch] = make(map[string]*gqlLoad)
+			order = append(order, l.batch)
+		}
+		batches[l.batch][l.key] = l
+	}
+	gr.pending = nil
+	for _, b := range order {
+		loads := batches[b]
+		keys := make([]string, 0, len(loads))
+		for k := range loads {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, group := range b.group(keys) {
+			j := job{run: func() {
+				results, err := b.fetch(gr, group)
+				for _, k := range group {
+					loads[k].result, loads[k].err = results[k], err
+				}
+			}}
+			for _, k := range group {
+				j.loads = append(j.loads, loads[k])
+			}
+			jobs = append(jobs, j)
+		}
+	}
+
+	if left := gqlMaxCalls - gr.made; len(jobs) > left {
+		err := errors.New("Query makes too many upstream calls, at most " + strconv.Itoa(gqlMaxCalls))
+		for _, j := range jobs[left:] {
+			for _, l := range j.loads {
+				l.err = err
+			}
+		}
+		jobs = jobs[:left]
+	}
+	gr.made += len(jobs)
+	sem := make(chan struct{}, gqlConcurrency)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			job.run()
+		}()
+	}
+	wg.Wait()
+}
+
+// A response object, with its members in the order they were asked for.
+type gqlOut struct {
+	keys []string
+	vals []interface{}
+}
+
+// An object whose fields are to be resolved at the next level.
+type gqlTask struct {
+	typ   *gqlType
+	obj   gqlObject
+	plans []*gqlPlan
+	out   *gqlOut
+	path  []interface{}
+}
+
+// Resolves a query level by level, so that the loads of each level are made together.
+func (gr *gqlRequest) execute(plans []*gqlPlan) *gqlOut {
+	root := &gqlOut{}
+	tasks := []gqlTask{{typ: gqlQuery, plans: plans, out: root}}
+	type resolving struct {
+		task  *gqlTask
+		plan  *gqlPlan
+		index int
+		thunk gqlThunk
+	}
+	for len(tasks) > 0 {
+		var level []resolving
+		for i := range tasks {
+			t := &tasks[i]
+			for _, plan := range t.plans {
+				t.out.keys = append(t.out.keys, plan.key)
+				t.out.vals = append(t.out.vals, nil)
+				level = append(level, resolving{task: t, plan: plan, index: len(t.out.vals) - 1, thunk: gr.resolve(t, plan)})
+			}
+		}
+		gr.flush()
+
+		var next []gqlTask
+		for _, r := range level {
+			path := append(r.task.path[:len(r.task.path):len(r.task.path)], r.plan.key)
+			v, err := r.thunk()
+			if err != nil {
+				gr.errors = append(gr.errors, gqlErrorOf(err, path))
+				continue
+			}
+			switch x := v.(type) {
+			case gqlObject:
+				out := &gqlOut{}
+				r.task.out.vals[r.index] = out
+				next = append(next, gqlTask{typ: r.plan.typ, obj: x, plans: r.plan.sub, out: out, path: path})
+			case []gqlObject:
+				list := make([]interface{}, len(x))
+				for i, obj := range x {
+					if obj == nil {
+						continue
+					}
+					out := &gqlOut{}
+					list[i] = out
+					next = append(next, gqlTask{typ: r.plan.typ, obj: obj, plans: r.plan.sub, out: out, path: append(path[:len(path):len(path)], i)})
+				}
+				r.task.out.vals[r.index] = list
+			default:
+				r.task.out.vals[r.index] = v
+			}
+		}
+		tasks = next
+	}
+	return root
+}
+
+func (gr *gqlRequest) resolve(t *gqlTask, plan *gqlPlan) gqlThunk {
+	switch {
+	case plan.field == &gqlTypenameField:
+		return gqlValue(json.RawMessage(strconv.Quote(t.typ.name)))
+	case plan.field.resolve != nil:
+		return plan.field.resolve(gr, t.obj, plan.args)
+	case plan.typ != nil:
+		return gqlValue(nil)
+	}
+	if v, ok := t.obj[plan.field.name]; ok {
+		return gqlValue(v)
+	}
+	return gqlValue(nil)
+}
+
+// A thunk of a value known already.
+func gqlValue(v interface{}) gqlThunk {
+	return func() (interface{}, error) { return v, nil }
+}
+
+func gqlErrorOf(err error, path []interface{}) *gqlError {
+	msg := err.Error()
+	var rerr *rpcError
+	if errors.As(err, &rerr) {
+		msg = rerr.Message
+	}
+	return &gqlError{Message: msg, Path: path}
+}
+
+func writeGQLValue(out *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case *gqlOut:
+		out.WriteByte('{')
+		for i, k := range x.keys {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(strconv.Quote(k))
+			out.WriteByte(':')
+			writeGQLValue(out, x.vals[i])
+		}
+		out.WriteByte('}')
+	case []interface{}:
+		out.WriteByte('[')
+		for i, item := range x {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			writeGQLValue(out, item)
+		}
+		out.WriteByte(']')
+	case json.RawMessage:
+		if len(x) == 0 {
+			out.WriteString("null")
+		} else {
+			out.Write(x)
+		}
+	case nil:
+		out.WriteString("null")
+	default:
+		b, _ := jsonit.Marshal(x)
+		out.Write(b)
+	}
+}
+
+// The schema in the GraphQL schema language.
+func gqlSDL() string {
+	var b strings.Builder
+	b.WriteString("scalar JSON\n")
+	for _, t := range gqlTypeList {
+		b.WriteString("\n\"\"\"" + t.desc + "\"\"\"\ntype " + t.name + " {\n")
+		for _, f := range t.fields {
+			if f.desc != "" {
+				b.WriteString("  \"" + f.desc + "\"\n")
+			}
+			b.WriteString("  " + f.name)
+			if len(f.args) > 0 {
+				args := make([]string, 0, len(f.args))
+				for _, a := range f.args {
+					arg := a.name + ": " + a.typ
+					if a.def != nil {
+						def, _ := jsonit.Marshal(a.def)
+						arg += " = " + string(def)
+					}
+					args = append(args, arg)
+				}
+				b.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			b.WriteString(": " + f.typ + "\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
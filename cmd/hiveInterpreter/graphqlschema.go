@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The types of the GraphQL schema. Fields are named as the APIs name them; those without a resolver are the member
+// of the same name of the object, as condenser_api gives it (as database_api does for witnesses, and block_api for
+// blocks).
+var gqlTypeList = []*gqlType{gqlQuery, gqlAccountType, gqlBlockType, gqlTransactionType, gqlOperationType, gqlPostType, gqlWitnessType}
+
+var gqlQuery = &gqlType{name: "Query", desc: "Lookups of the chain and its content.", fields: []gqlField{
+	{name: "account", typ: "Account", args: []gqlFieldArg{{name: "name", typ: "String!"}}, resolve: gqlResolveAccount},
+	{name: "accounts", typ: "[Account]", args: []gqlFieldArg{{name: "names", typ: "[String!]!"}}, size: gqlSizeOf("names"), resolve: gqlResolveAccounts},
+	{name: "block", typ: "Block", args: []gqlFieldArg{{name: "num", typ: "Int!"}}, resolve: gqlResolveBlock},
+	{name: "blocks", typ: "[Block]", desc: "Consecutive blocks, at most 100.", args: []gqlFieldArg{{name: "from", typ: "Int!"}, {name: "count", typ: "Int", def: json.Number("10")}},
+		size: gqlSizeArg("count"), resolve: gqlResolveBlocks},
+	{name: "transaction", typ: "Transaction", args: []gqlFieldArg{{name: "id", typ: "String!"}}, resolve: gqlResolveTransaction},
+	{name: "post", typ: "Post", args: []gqlFieldArg{{name: "author", typ: "String!"}, {name: "permlink", typ: "String!"}}, resolve: gqlResolvePost},
+	{name: "witness", typ: "Witness", args: []gqlFieldArg{{name: "name", typ: "String!"}}, resolve: gqlResolveWitness},
+	{name: "witnesses", typ: "[Witness]", desc: "Witnesses by vote, from start.", args: []gqlFieldArg{{name: "start", typ: "String", def: ""}, {name: "limit", typ: "Int", def: json.Number("100")}},
+		size: gqlSizeArg("limit"), resolve: gqlResolveWitnesses},
+	{name: "dynamic_global_properties", typ: "JSON", resolve: gqlResolveProperties},
+}}
+
+var gqlAccountType = &gqlType{name: "Account", desc: "An account.", fields: gqlFields(
+	gqlLeaves("Int", "id", "post_count", "witnesses_voted_for"),
+	gqlLeaves("String", "name", "balance", "hbd_balance", "savings_balance", "savings_hbd_balance", "vesting_shares",
+		"delegated_vesting_shares", "received_vesting_shares", "vesting_withdraw_rate", "reward_hive_balance", "reward_hbd_balance",
+		"reward_vesting_balance", "created", "last_post", "last_vote_time", "recovery_account", "proxy", "json_metadata", "posting_json_metadata"),
+	gqlLeaves("Boolean", "can_vote"),
+	gqlLeaves("[String]", "witness_votes"),
+	gqlLeaves("JSON", "reputation", "voting_manabar", "downvote_manabar", "owner", "active", "posting", "memo_key"),
+	[]gqlField{
+		{name: "history", typ: "[Operation]", desc: "Operations, oldest first, up to start, -1 for the latest.",
+			args: []gqlFieldArg{{name: "start", typ: "Int", def: json.Number("-1")}, {name: "limit", typ: "Int", def: json.Number("100")}},
+			size: gqlSizeArg("limit"), resolve: gqlResolveHistory},
+		{name: "witness", typ: "Witness", desc: "The account's witness, if it is one.", resolve: gqlResolveAccountWitness},
+	},
+)}
+
+var gqlBlockType = &gqlType{name: "Block", desc: "A block.", fields: gqlFields(
+	gqlLeaves("Int", "block_num"),
+	gqlLeaves("String", "block_id", "previous", "timestamp", "witness", "transaction_merkle_root", "signing_key", "witness_signature"),
+	gqlLeaves("[String]", "transaction_ids"),
+	gqlLeaves("JSON", "extensions"),
+	[]gqlField{
+		{name: "transactions", typ: "[Transaction]", size: gqlSize(50), resolve: gqlResolveBlockTransactions},
+		{name: "ops", typ: "[Operation]", desc: "The operations of the block, including virtual ones.",
+			args: []gqlFieldArg{{name: "only_virtual", typ: "Boolean", def: false}}, size: gqlSize(100), resolve: gqlResolveBlockOps},
+		{name: "producer", typ: "Witness", desc: "The witness that produced the block.", resolve: gqlResolveProducer},
+	},
+)}
+
+var gqlTransactionType = &gqlType{name: "Transaction", desc: "A transaction.", fields: gqlFields(
+	gqlLeaves("Int", "block_num", "transaction_num", "ref_block_num", "ref_block_prefix"),
+	gqlLeaves("String", "transaction_id", "expiration"),
+	gqlLeaves("[String]", "signatures"),
+	gqlLeaves("JSON", "extensions"),
+	[]gqlField{
+		{name: "operations", typ: "[Operation]", size: gqlSize(5), resolve: gqlResolveTransactionOps},
+		{name: "block", typ: "Block", resolve: gqlResolveTransactionBlock},
+	},
+)}
+
+var gqlOperationType = &gqlType{name: "Operation", desc: "An operation, with where it is in the chain when known.", fields: gqlFields(
+	[]gqlField{
+		{name: "type", typ: "String", desc: "The type, such as vote or transfer."},
+		{name: "value", typ: "JSON"},
+	},
+	gqlLeaves("Int", "seq", "block", "trx_in_block", "op_in_trx"),
+	gqlLeaves("String", "trx_id", "timestamp"),
+	gqlLeaves("JSON", "virtual_op"),
+)}
+
+var gqlPostType = &gqlType{name: "Post", desc: "A post or comment.", fields: gqlFields(
+	gqlLeaves("Int", "id", "depth", "children", "net_votes"),
+	gqlLeaves("String", "author", "permlink", "category", "parent_author", "parent_permlink", "title", "body", "json_metadata",
+		"created", "last_update", "active", "url", "root_title", "pending_payout_value", "total_payout_value", "curator_payout_value"),
+	gqlLeaves("JSON", "author_reputation", "active_votes", "beneficiaries"),
+	[]gqlField{
+		{name: "author_account", typ: "Account", resolve: gqlResolvePostAuthor},
+		{name: "parent", typ: "Post", desc: "The post replied to, for comments.", resolve: gqlResolvePostParent},
+		{name: "replies", typ: "[Post]", desc: "The direct replies.", resolve: gqlResolvePostReplies},
+	},
+)}
+
+var gqlWitnessType = &gqlType{name: "Witness", desc: "A witness.", fields: gqlFields(
+	gqlLeaves("Int", "id", "total_missed", "last_confirmed_block_num"),
+	gqlLeaves("String", "owner", "url", "created", "signing_key", "running_version", "hardfork_version_vote", "hardfork_time_vote",
+		"last_hbd_exchange_update", "virtual_scheduled_time"),
+	gqlLeaves("JSON", "votes", "props", "hbd_exchange_rate"),
+	[]gqlField{
+		{name: "account", typ: "Account", resolve: gqlResolveWitnessAccount},
+	},
+)}
+
+func gqlTypeNamed(name string) *gqlType {
+	for _, t := range gqlTypeList {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func gqlFields(groups ...[]gqlField) []gqlField {
+	var fields []gqlField
+	for _, g := range groups {
+		fields = append(fields, g...)
+	}
+	return fields
+}
+
+// Fields of a type that are members of the object.
+func gqlLeaves(typ string, names ...string) []gqlField {
+	fields := make([]gqlField, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, gqlField{name: name, typ: typ})
+	}
+	return fields
+}
+
+func gqlSize(n int) func(map[string]interface{}) int {
+	return func(map[string]interface{}) int { return n }
+}
+
+// A list as long as an Int argument.
+func gqlSizeArg(name string) func(map[string]interface{}) int {
+	return func(args map[string]interface{}) int {
+		n, _ := MaybeGetInt64(args[name])
+		return int(max(0, min(n, gqlMaxCost)))
+	}
+}
+
+// A list as long as a list argument.
+func gqlSizeOf(name string) func(map[string]interface{}) int {
+	return func(args map[string]interface{}) int {
+		list, _ := args[name].([]interface{})
+		return len(list)
+	}
+}
+
+// Accounts, by name, many to a call.
+var gqlAccounts = &gqlBatch{group: gqlChunks(100), fetch: func(gr *gqlRequest, names []string) (map[string]json.RawMessage, error) {
+	result, err := gr.fetch("condenser_api.get_accounts", []interface{}{names})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	var list []json.RawMessage
+	if err := jsonit.Unmarshal(result, &list); err != nil {
+		return nil, err
+	}
+	return gqlIndex(list, "name"), nil
+}}
+
+// Witnesses, by owner, many to a call.
+var gqlWitnesses = &gqlBatch{group: gqlChunks(100), fetch: func(gr *gqlRequest, owners []string) (map[string]json.RawMessage, error) {
+	result, err := gr.fetch("database_api.find_witnesses", map[string]interface{}{"owners": owners})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	var found struct {
+		Witnesses []json.RawMessage `json:"witnesses"`
+	}
+	if err := jsonit.Unmarshal(result, &found); err != nil {
+		return nil, err
+	}
+	return gqlIndex(found.Witnesses, "owner"), nil
+}}
+
+// Blocks, by number, each in its own call as ranges of blocks are not allowed. Blocks are given with their number.
+var gqlBlocks = &gqlBatch{group: gqlChunks(1), fetch: func(gr *gqlRequest, nums []string) (map[string]json.RawMessage, error) {
+	num, err := strconv.ParseInt(nums[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	result, err := gr.fetch("block_api.get_block", map[string]interface{}{"block_num": num})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	var found struct {
+		Block json.RawMessage `json:"block"`
+	}
+	if err := jsonit.Unmarshal(result, &found); err != nil {
+		return nil, err
+	}
+	if found.Block == nil || string(found.Block) == "null" {
+		return nil, nil
+	}
+	block, err := prependMember(found.Block, "block_num", json.RawMessage(nums[0]))
+	return map[string]json.RawMessage{nums[0]: block}, err
+}}
+
+// Groups keys up to n at a time.
+func gqlChunks(n int) func([]string) [][]string {
+	return func(keys []string) [][]string {
+		var groups [][]string
+		for len(keys) > n {
+			groups = append(groups, keys[:n])
+			keys = keys[n:]
+		}
+		return append(groups, keys)
+	}
+}
+
+// Objects of a list by a member holding a string.
+func gqlIndex(list []json.RawMessage, member string) map[string]json.RawMessage {
+	byKey := make(map[string]json.RawMessage, len(list))
+	for _, raw := range list {
+		var obj map[string]json.RawMessage
+		var key string
+		if jsonit.Unmarshal(raw, &obj) == nil && jsonit.Unmarshal(obj[member], &key) == nil {
+			byKey[key] = raw
+		}
+	}
+	return byKey
+}
+
+// A thunk giving the object a load got, or null.
+func (l *gqlLoad) object() gqlThunk {
+	return func() (interface{}, error) {
+		if l.err != nil {
+			return nil, l.err
+		}
+		return gqlObjectOf(l.result)
+	}
+}
+
+// A thunk giving the objects the loads got, with null for those not found.
+func gqlObjects(loads []*gqlLoad) gqlThunk {
+	return func() (interface{}, error) {
+		list := make([]gqlObject, 0, len(loads))
+		for _, l := range loads {
+			if l.err != nil {
+				return nil, l.err
+			}
+			obj, err := gqlObjectOf(l.result)
+			if err != nil {
+				return nil, err
+			}
+			o, _ := obj.(gqlObject)
+			list = append(list, o)
+		}
+		return list, nil
+	}
+}
+
+// A thunk giving the list of objects a load got, each made by of.
+func (l *gqlLoad) list(of func(json.RawMessage) (gqlObject, error)) gqlThunk {
+	return func() (interface{}, error) {
+		if l.err != nil {
+			return nil, l.err
+		}
+		return gqlListOf(l.result, of)
+	}
+}
+
+func gqlObjectOf(raw json.RawMessage) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var obj gqlObject
+	if err := jsonit.Unmarshal(raw, &obj); err != nil {
+		return nil, errors.New("Bad Gateway")
+	}
+	if obj == nil {
+		return nil, nil
+	}
+	return obj, nil
+}
+
+func gqlListOf(raw json.RawMessage, of func(json.RawMessage) (gqlObject, error)) ([]gqlObject, error) {
+	var items []json.RawMessage
+	if raw != nil {
+		if err := jsonit.Unmarshal(raw, &items); err != nil {
+			return nil, errors.New("Bad Gateway")
+		}
+	}
+	list := make([]gqlObject, 0, len(items))
+	for _, item := range items {
+		obj, err := of(item)
+		if err != nil {
+			return nil, errors.New("Bad Gateway")
+		}
+		list = append(list, obj)
+	}
+	return list, nil
+}
+
+func gqlPlainObject(raw json.RawMessage) (gqlObject, error) {
+	var obj gqlObject
+	err := jsonit.Unmarshal(raw, &obj)
+	return obj, err
+}
+
+// Operations are given as [type, value] pairs by condenser_api, and as {type, value} objects with the type suffixed
+// _operation by the other APIs, either possibly in an entry saying where it is. All are made a {type, value} object
+// with the short type, along with the members of their entry.
+func gqlOperationOf(raw json.RawMessage) (gqlObject, error) {
+	var obj gqlObject
+	if jsonit.Unmarshal(raw, &obj) == nil && obj != nil {
+		if op, ok := obj["op"]; ok {
+			inner, err := gqlOperationOf(op)
+			if err != nil {
+				return nil, err
+			}
+			delete(obj, "op")
+			for k, v := range inner {
+				obj[k] = v
+			}
+			return obj, nil
+		}
+		var typ string
+		if err := jsonit.Unmarshal(obj["type"], &typ); err != nil {
+			return nil, err
+		}
+		obj["type"] = json.RawMessage(strconv.Quote(strings.TrimSuffix(typ, "_operation")))
+		return obj, nil
+	}
+	var pair [2]json.RawMessage
+	if err := jsonit.Unmarshal(raw, &pair); err != nil {
+		return nil, err
+	}
+	return gqlObject{"type": pair[0], "value": pair[1]}, nil
+}
+
+// A string member of an object, or "".
+func (obj gqlObject) str(member string) string {
+	var s string
+	jsonit.Unmarshal(obj[member], &s)
+	return s
+}
+
+func gqlFail(msg string) gqlThunk {
+	return func() (interface{}, error) { return nil, errors.New(msg) }
+}
+
+func gqlResolveAccount(gr *gqlRequest, _ gqlObject, args map[string]interface{}) gqlThunk {
+	return gr.item(gqlAccounts, args["name"].(string)).object()
+}
+
+func gqlResolveAccounts(gr *gqlRequest, _ gqlObject, args map[string]interface{}) gqlThunk {
+	var loads []*gqlLoad
+	for _, name := range args["names"].([]interface{}) {
+		loads = append(loads, gr.item(gqlAccounts, name.(string)))
+	}
+	return gqlObjects(loads)
+}
+
+func gqlResolveBlock(gr *gqlRequest, _ gqlObject, args map[string]interface{}) gqlThunk {
+	num, _ := MaybeGetInt64(args["num"])
+	return gr.item(gqlBlocks, strconv.FormatInt(num, 10)).object()
+}
+
+func gqlResolveBlocks(gr *gqlRequest, _ gqlObject, args map[string]interface{}) gqlThunk {
+	from, _ := MaybeGetInt64(args["from"])
+	count, _ := MaybeGetInt64(args["count"])
+	if count < 0 || count > 100 {
+		return gqlFail("count must be from 0 to 100")
+	}
+	var loads []*gqlLoad
+	for i := int64(0); i < count; i++ {
+		loads = append(loads, gr.item(gqlBlocks, strconv.FormatInt(from+i, 10)))
+	}
+	return gqlObjects(loads)
+}
+
+func gqlResolveTransaction(gr *gqlRequest, _ gqlObject, args map[string]interface{}) gqlThunk {
+	return gr.call("condenser_api.get_transaction", []interface{}{args["id"]}).object()
+}
+
+func gqlResolvePost(gr *gqlRequest, _ gqlObject, args map[string]interface{}) gqlThunk {
+	return gqlPost(gr.call("condenser_api.get_content", []interface{}{args["author"], args["permlink"]}))
+}
+
+// Missing posts are given with no author.
+func gqlPost(l *gqlLoad) gqlThunk {
+	thunk := l.object()
+	return func() (interface{}, error) {
+		v, err := thunk()
+		if obj, ok := v.(gqlObject); ok && obj.str("author") == "" {
+			return nil, err
+		}
+		return v, err
+	}
+}
+
+func gqlResolveWitness(gr *gqlRequest, _ gqlObject, args map[string]interface{}) gqlThunk {
+	return gr.item(gqlWitnesses, args["name"].(string)).object()
+}
+
+func gqlResolveWitnesses(gr *gqlRequest, _ gqlObject, args map[string]interface{}) gqlThunk {
+	if limit, _ := MaybeGetInt64(args["limit"]); limit < 1 || limit > maxPageLimit {
+		return gqlFail("limit must be from 1 to " + strconv.Itoa(maxPageLimit))
+	}
+	return gr.call("condenser_api.get_witnesses_by_vote", []interface{}{args["start"], args["limit"]}).list(gqlPlainObject)
+}
+
+func gqlResolveProperties(gr *gqlRequest, _ gqlObject, _ map[string]interface{}) gqlThunk {
+	l := gr.call("database_api.get_dynamic_global_properties", map[string]interface{}{})
+	return func() (interface{}, error) { return l.result, l.err }
+}
+
+func gqlResolveHistory(gr *gqlRequest, obj gqlObject, args map[string]interface{}) gqlThunk {
+	if limit, _ := MaybeGetInt64(args["limit"]); limit < 1 || limit > maxPageLimit {
+		return gqlFail("limit must be from 1 to " + strconv.Itoa(maxPageLimit))
+	}
+	l := gr.call("condenser_api.get_account_history", []interface{}{obj.str("name"), args["start"], args["limit"]})
+	return l.list(func(raw json.RawMessage) (gqlObject, error) {
+		entry, err := historyRow(raw)
+		if err != nil {
+			return nil, err
+		}
+		return gqlOperationOf(entry)
+	})
+}
+
+func gqlResolveAccountWitness(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	return gr.item(gqlWitnesses, obj.str("name")).object()
+}
+
+// Transactions are given with where they are, which blocks leave implicit.
+func gqlResolveBlockTransactions(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	var txs []json.RawMessage
+	var ids []json.RawMessage
+	if jsonit.Unmarshal(obj["transactions"], &txs) != nil || jsonit.Unmarshal(obj["transaction_ids"], &ids) != nil {
+		return gqlFail("Bad Gateway")
+	}
+	list := make([]gqlObject, 0, len(txs))
+	for i, raw := range txs {
+		tx, err := gqlPlainObject(raw)
+		if err != nil || tx == nil {
+			return gqlFail("Bad Gateway")
+		}
+		if i < len(ids) {
+			tx["transaction_id"] = ids[i]
+		}
+		tx["block_num"] = obj["block_num"]
+		tx["transaction_num"] = json.RawMessage(strconv.Itoa(i))
+		list = append(list, tx)
+	}
+	return gqlValue(list)
+}
+
+func gqlResolveBlockOps(gr *gqlRequest, obj gqlObject, args map[string]interface{}) gqlThunk {
+	return gr.call("condenser_api.get_ops_in_block", []interface{}{obj["block_num"], args["only_virtual"]}).list(gqlOperationOf)
+}
+
+func gqlResolveProducer(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	return gr.item(gqlWitnesses, obj.str("witness")).object()
+}
+
+// Operations are given with the transaction they are in.
+func gqlResolveTransactionOps(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	ops, err := gqlListOf(obj["operations"], gqlOperationOf)
+	if err != nil {
+		return gqlFail(err.Error())
+	}
+	for i, op := range ops {
+		op["trx_id"], op["block"], op["trx_in_block"] = obj["transaction_id"], obj["block_num"], obj["transaction_num"]
+		op["op_in_trx"] = json.RawMessage(strconv.Itoa(i))
+	}
+	return gqlValue(ops)
+}
+
+func gqlResolveTransactionBlock(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	num, ok := MaybeGetInt64(json.Number(obj["block_num"]))
+	if !ok {
+		return gqlValue(nil)
+	}
+	return gr.item(gqlBlocks, strconv.FormatInt(num, 10)).object()
+}
+
+func gqlResolvePostAuthor(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	return gr.item(gqlAccounts, obj.str("author")).object()
+}
+
+func gqlResolvePostParent(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	if obj.str("parent_author") == "" {
+		return gqlValue(nil)
+	}
+	return gqlPost(gr.call("condenser_api.get_content", []interface{}{obj.str("parent_author"), obj.str("parent_permlink")}))
+}
+
+func gqlResolvePostReplies(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	return gr.call("condenser_api.get_content_replies", []interface{}{obj.str("author"), obj.str("permlink")}).list(gqlPlainObject)
+}
+
+func gqlResolveWitnessAccount(gr *gqlRequest, obj gqlObject, _ map[string]interface{}) gqlThunk {
+	return gr.item(gqlAccounts, obj.str("owner")).object()
+}
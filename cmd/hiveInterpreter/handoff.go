@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment used to pass listening sockets to a new process. This is the systemd socket activation protocol:
+// LISTEN_FDS sockets starting at fd 3, optionally named by LISTEN_FDNAMES. When handing off between interpreter
+// processes, LISTEN_PID is left unset and the new process reports it is serving by writing to HIVEINTERPRETER_READY_FD.
+const (
+	envListenFds   = "LISTEN_FDS"
+	envListenPid   = "LISTEN_PID"
+	envListenNames = "LISTEN_FDNAMES"
+	envReadyFd     = "HIVEINTERPRETER_READY_FD"
+	listenFdsStart = 3
+)
+
+// How long the old process waits for its replacement to start serving before giving up on the handoff.
+const handoffTimeout = 30 * time.Second
+
+// Listening sockets passed in by systemd or by a previous interpreter process, keyed by both name and address.
+var inherited map[string]net.Listener
+
+// Whether the inherited sockets belong to this process to clean up, rather than to systemd.
+var inheritedOwned bool
+
+// Picks up any listening sockets passed to this process. Must be called once at startup, before listening.
+func loadInheritedListeners() error {
+	nfds, err := strconv.Atoi(os.Getenv(envListenFds))
+	if err != nil || nfds <= 0 {
+		return nil
+	}
+	if pid := os.Getenv(envListenPid); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	names := strings.Split(os.Getenv(envListenNames), ":")
+	inheritedOwned = os.Getenv(envListenPid) == ""
+	os.Unsetenv(envListenFds)
+	os.Unsetenv(envListenPid)
+	os.Unsetenv(envListenNames)
+
+	inherited = make(map[string]net.Listener)
+	for i := 0; i < nfds; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "listener"+strconv.Itoa(i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		inherited[l.Addr().String()] = l
+		if i < len(names) && names[i] != "" {
+			inherited[fdName(names[i])] = l
+		}
+		if debug {
+			log.Println("Inherited listener", names, l.Addr())
+		}
+	}
+	return nil
+}
+
+// Returns the inherited listener with the given name or address, if any.
+func takeInherited(name string, addr string) (net.Listener, bool) {
+	if l, ok := inherited[fdName(name)]; ok {
+		return l, true
+	}
+	l, ok := inherited[addr]
+	return l, ok
+}
+
+// Listener names are passed colon separated, so colons (as in tcp addresses) are replaced.
+func fdName(name string) string {
+	return strings.ReplaceAll(name, ":", "_")
+}
+
+// Tells a previous interpreter process that this one is now serving, so it can start draining.
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFd))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(envReadyFd)
+	f := os.NewFile(uintptr(fd), "ready")
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Println("Notifying previous process:", err)
+	}
+	f.Close()
+}
+
+// Starts a new copy of the interpreter binary that inherits the listening sockets, and waits until it reports
+// that it is serving. On success the caller should drain and exit, leaving the sockets in place.
+func handoff(listeners []*serveListener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var names []string
+	for _, sl := range listeners {
+		fl, ok := sl.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.New("listener " + sl.name + " cannot be passed to another process")
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, fdName(sl.name))
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case envListenFds, envListenPid, envListenNames, envReadyFd:
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		envListenFds+"="+strconv.Itoa(len(listeners)),
+		envListenNames+"="+strings.Join(names, ":"),
+		envReadyFd+"="+strconv.Itoa(listenFdsStart+len(listeners)))
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Our copy of the write end must be closed, so that the read sees EOF if the new process dies early.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	ready.SetReadDeadline(time.Now().Add(handoffTimeout))
+	buf := make([]byte, 1)
+	if n, err := ready.Read(buf); n != 1 {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process (pid %d) did not become ready: %v", cmd.Process.Pid, err)
+	}
+	log.Println("Handed off listeners to pid", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Block interval of the chain.
+	blockInterval = 3 * time.Second
+	// How long after a block's timestamp to expect it to be available from the upstream.
+	headFetchDelay = 250 * time.Millisecond
+	// Bounds on the wait between refreshes, for when the upstream clock and ours disagree or a block is missed.
+	headMinRefresh = 500 * time.Millisecond
+	headMaxRefresh = blockInterval
+	// Beyond this age the tracked properties are not used, and callers fetch their own.
+	headMaxAge = 3 * blockInterval
+)
+
+// Keeps the current dynamic global properties, refreshed from the lite upstream once per block,
+// so that every handler shares one view of the head block and chain time.
+type headTracker struct {
+	mu      sync.RWMutex
+	dgp     dynamicGlobalProperties
+	updated time.Time
+	// Closed and replaced whenever the head block advances.
+	advanced chan struct{}
+}
+
+var head = &headTracker{advanced: make(chan struct{})}
+
+// Starts refreshing in the background, until shutdown.
+func (ht *headTracker) start() {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-shutdownCtx.Done():
+				return
+			}
+			timer.Reset(ht.refresh())
+		}
+	}()
+}
+
+// Fetches the properties, and returns how long to wait until the next block should be available.
+func (ht *headTracker) refresh() time.Duration {
+	dgp, err := fetchDynamicGlobalProperties(context.Background(), ep2pool[liteep])
+	if err != nil {
+		log.Println("Head tracker:", err)
+		return headMaxRefresh
+	}
+	ht.set(dgp)
+
+	headTime, err := time.Parse(chainTimeLayout, dgp.Time)
+	if err != nil {
+		return headMaxRefresh
+	}
+	wait := time.Until(headTime.Add(blockInterval + headFetchDelay))
+	if wait < headMinRefresh {
+		wait = headMinRefresh
+	}
+	if wait > headMaxRefresh {
+		wait = headMaxRefresh
+	}
+	return wait
+}
+
+// Records new properties, notifying waiters if the head advanced.
+func (ht *headTracker) set(dgp dynamicGlobalProperties) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if dgp.HeadBlockNumber < ht.dgp.HeadBlockNumber {
+		return
+	}
+	advanced := dgp.HeadBlockNumber > ht.dgp.HeadBlockNumber
+	ht.dgp = dgp
+	ht.updated = time.Now()
+	if advanced {
+		close(ht.advanced)
+		ht.advanced = make(chan struct{})
+	}
+}
+
+// The tracked properties, if they are recent enough to use.
+func (ht *headTracker) get() (dynamicGlobalProperties, bool) {
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	return ht.dgp, !ht.updated.IsZero() && time.Since(ht.updated) < headMaxAge
+}
+
+// A channel that is closed when the head block next advances.
+func (ht *headTracker) nextBlock() <-chan struct{} {
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	return ht.advanced
+}
+
+// Last irreversible block number, or 0 if unknown.
+func (ht *headTracker) lastIrreversible() int64 {
+	dgp, ok := ht.get()
+	if !ok {
+		return 0
+	}
+	return dgp.LastIrreversibleBlockNum
+}
+
+// The current dynamic global properties: from the tracker, or fetched through the given pool if the tracker has none.
+func currentHead(ctx context.Context, jobp jobPool) (dynamicGlobalProperties, error) {
+	if dgp, ok := head.get(); ok {
+		return dgp, nil
+	}
+	dgp, err := fetchDynamicGlobalProperties(ctx, jobp)
+	if err != nil {
+		return dgp, err
+	}
+	head.set(dgp)
+	return dgp, nil
+}
+
+func fetchDynamicGlobalProperties(ctx context.Context, jobp jobPool) (dynamicGlobalProperties, error) {
+	reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "database_api.get_dynamic_global_properties", "params": map[string]interface{}{}}
+	var dgp dynamicGlobalProperties
+	err := requestToResult(ctx, jobp, reqmessage, &dgp)
+	return dgp, err
+}
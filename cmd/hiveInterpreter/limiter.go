@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Bounds on the concurrency allowed to an upstream. The upper bound is the number of workers (-w).
+	limiterMin = 2
+	// Latency above this multiple of the baseline is taken as the upstream queueing.
+	limiterLatencyTolerance = 2.0
+	// Latency rises smaller than this, in seconds, are ignored, so that jitter on fast upstreams is not taken as overload.
+	limiterLatencySlack = 0.010
+	// Multiplier applied to the limit on overload.
+	limiterBackoff = 0.9
+	// Smoothing of the recent and baseline latency averages.
+	limiterRecentWeight   = 0.1
+	limiterBaselineWeight = 0.01
+	// An upstream is overloaded while the smoothed queue wait exceeds this fraction of maxQueueWait.
+	limiterOverloadFraction = 0.25
+)
+
+// Longest a request waits for a slot, set from flags. Requests that have waited longer when their turn comes
+// are dropped rather than sent upstream, as the client has probably given up.
+var maxQueueWait = time.Second
+
+// Adjusts the requests in flight to an upstream with AIMD: the limit grows by one per limit's worth of requests
+// that complete quickly and successfully, and is cut back when latency rises above its baseline or requests fail.
+// Requests beyond the limit wait, for up to maxQueueWait, and are let through by priority class and client.
+type adaptiveLimiter struct {
+	name string
+	max  int
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	waiting  int
+	classes  map[string]*waitClass
+
+	queueWait   float64 // Seconds, smoothed over recent requests.
+	shedding    bool
+	recent      float64 // Seconds, smoothed over recent requests.
+	baseline    float64 // Seconds, smoothed over a long window: the latency when not overloaded.
+	lastBackoff time.Time
+}
+
+type limiterWaiter struct {
+	ctx      context.Context
+	tag      jobTag
+	enqueued time.Time
+	ready    chan struct{}
+	granted  bool
+	dropped  bool
+}
+
+// Requests of one priority class waiting for a slot, queued per client.
+type waitClass struct {
+	weight  int
+	shed    bool // Rejected outright while overloaded.
+	current int  // Smooth weighted round robin state.
+	clients []string
+	next    int
+	queues  map[string][]*limiterWaiter
+}
+
+func (wc *waitClass) push(wt *limiterWaiter) {
+	q, ok := wc.queues[wt.tag.client]
+	if !ok {
+		wc.clients = append(wc.clients, wt.tag.client)
+	}
+	wc.queues[wt.tag.client] = append(q, wt)
+}
+
+// Takes the first waiter of the next client in turn.
+func (wc *waitClass) pop() *limiterWaiter {
+	if wc.next >= len(wc.clients) {
+		wc.next = 0
+	}
+	client := wc.clients[wc.next]
+	q := wc.queues[client]
+	wt := q[0]
+	if len(q) == 1 {
+		wc.dropClient(wc.next)
+	} else {
+		wc.queues[client] = q[1:]
+		wc.next++
+	}
+	return wt
+}
+
+// Removes a waiter that gave up. Returns false if it was not queued.
+func (wc *waitClass) remove(wt *limiterWaiter) bool {
+	q := wc.queues[wt.tag.client]
+	for i, w := range q {
+		if w != wt {
+			continue
+		}
+		if len(q) > 1 {
+			wc.queues[wt.tag.client] = append(q[:i], q[i+1:]...)
+			return true
+		}
+		for ci, c := range wc.clients {
+			if c == wt.tag.client {
+				wc.dropClient(ci)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (wc *waitClass) dropClient(i int) {
+	delete(wc.queues, wc.clients[i])
+	wc.clients = append(wc.clients[:i], wc.clients[i+1:]...)
+	if wc.next > i {
+		wc.next--
+	}
+}
+
+func newAdaptiveLimiter(name string, max int) *adaptiveLimiter {
+	if max < limiterMin {
+		max = limiterMin
+	}
+	initial := max / 4
+	if initial < limiterMin {
+		initial = limiterMin
+	}
+	classes := make(map[string]*waitClass)
+	for class, weight := range priorityClasses {
+		// Classes weighted below the default are the low priority ones.
+		shed := weight < priorityClasses[defaultPriorityClass]
+		classes[class] = &waitClass{weight: weight, shed: shed, queues: make(map[string][]*limiterWaiter)}
+	}
+	return &adaptiveLimiter{name: name, max: max, limit: float64(initial), classes: classes}
+}
+
+// Whether requests are queueing for long enough that low priority ones should be turned away.
+func (al *adaptiveLimiter) isOverloaded() bool {
+	return al.queueWait > maxQueueWait.Seconds()*limiterOverloadFraction
+}
+
+// Takes a slot for a tagged request enqueued at the given time, waiting until its turn.
+// Returns 0 once it has a slot, or the status to fail the request with: 503 if it was shed because the upstream
+// is overloaded, or 504 if it waited past maxQueueWait or ctx was cancelled.
+func (al *adaptiveLimiter) acquire(ctx context.Context, tag jobTag, enqueued time.Time) int {
+	al.mu.Lock()
+	wc, ok := al.classes[tag.class]
+	if !ok {
+		wc = al.classes[defaultPriorityClass]
+		tag.class = defaultPriorityClass
+	}
+	if al.waiting == 0 && al.inflight < int(al.limit) {
+		al.inflight++
+		al.recordQueueWait(0)
+		al.mu.Unlock()
+		return 0
+	}
+	// Only requests that would have to queue are shed, so that the overload clears once the queue does.
+	if wc.shed && al.isOverloaded() {
+		al.mu.Unlock()
+		return http.StatusServiceUnavailable
+	}
+	wt := &limiterWaiter{ctx: ctx, tag: tag, enqueued: enqueued, ready: make(chan struct{})}
+	wc.push(wt)
+	al.waiting++
+	al.mu.Unlock()
+
+	timer := time.NewTimer(maxQueueWait - time.Since(enqueued))
+	defer timer.Stop()
+	select {
+	case <-wt.ready:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	switch {
+	case wt.granted:
+		return 0
+	case wt.dropped:
+		return http.StatusGatewayTimeout
+	}
+	if wc.remove(wt) {
+		al.waiting--
+	}
+	// Waiting this long is itself a sign of overload, though the request never got a turn.
+	al.recordQueueWait(time.Since(enqueued))
+	return http.StatusGatewayTimeout
+}
+
+func (al *adaptiveLimiter) recordQueueWait(wait time.Duration) {
+	al.queueWait += limiterRecentWeight * (wait.Seconds() - al.queueWait)
+	if overloaded := al.isOverloaded(); overloaded != al.shedding {
+		al.shedding = overloaded
+		if overloaded {
+			log.Printf("Upstream %s overloaded (queue wait %.3fs), rejecting low priority requests", al.name, al.queueWait)
+		} else {
+			log.Printf("Upstream %s no longer overloaded", al.name)
+		}
+	}
+}
+
+// Takes the next waiter: from the class picked by smooth weighted round robin, among those with waiters.
+// Must be called with waiters present, and the lock held.
+func (al *adaptiveLimiter) nextWaiter() *limiterWaiter {
+	var best *waitClass
+	total := 0
+	for _, wc := range al.classes {
+		if len(wc.clients) == 0 {
+			continue
+		}
+		wc.current += wc.weight
+		total += wc.weight
+		if best == nil || wc.current > best.current {
+			best = wc
+		}
+	}
+	best.current -= total
+	al.waiting--
+	return best.pop()
+}
+
+// Returns a slot, adjusting the limit by how the request went. Failed is for transport and server errors.
+// Requests that never reached the upstream give no sample.
+func (al *adaptiveLimiter) release(latency time.Duration, failed bool, sample bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.inflight--
+	if sample {
+		al.update(latency.Seconds(), failed)
+	}
+	for al.waiting > 0 && al.inflight < int(al.limit) {
+		wt := al.nextWaiter()
+		// Drop requests whose client has gone or given up, rather than spend a slot on them.
+		wait := time.Since(wt.enqueued)
+		if wt.ctx.Err() != nil || wait > maxQueueWait {
+			wt.dropped = true
+			close(wt.ready)
+			continue
+		}
+		al.recordQueueWait(wait)
+		wt.granted = true
+		al.inflight++
+		close(wt.ready)
+	}
+}
+
+func (al *adaptiveLimiter) update(latency float64, failed bool) {
+	if !failed {
+		if al.baseline == 0 {
+			al.baseline, al.recent = latency, latency
+		}
+		al.recent += limiterRecentWeight * (latency - al.recent)
+		// The baseline follows improvements quickly and degradations slowly, so it tracks the unloaded latency.
+		if latency < al.baseline {
+			al.baseline += limiterRecentWeight * (latency - al.baseline)
+		} else {
+			al.baseline += limiterBaselineWeight * (latency - al.baseline)
+		}
+	}
+
+	overloaded := failed || (al.recent > al.baseline*limiterLatencyTolerance && al.recent-al.baseline > limiterLatencySlack)
+	if overloaded {
+		// Back off at most once per baseline latency, so that one burst of slow requests counts once.
+		now := time.Now()
+		if now.Sub(al.lastBackoff).Seconds() < al.baseline+limiterLatencySlack {
+			return
+		}
+		al.lastBackoff = now
+		al.limit *= limiterBackoff
+		if al.limit < limiterMin {
+			al.limit = limiterMin
+		}
+		if debug {
+			log.Printf("Concurrency limit for %s down to %.1f (latency %.3fs, baseline %.3fs, failed %v)", al.name, al.limit, al.recent, al.baseline, failed)
+		}
+		return
+	}
+	// Only grow while the limit is being used, so that it does not run away while idle.
+	if float64(al.inflight+1)*2 >= al.limit {
+		al.limit += 1 / al.limit
+		if al.limit > float64(al.max) {
+			al.limit = float64(al.max)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A socket the interpreter serves on.
+type serveListener struct {
+	net.Listener
+	name   string
+	path   string // Socket file, for unix sockets.
+	policy *listenPolicy
+	certs  *certReloader // Set for TLS listeners.
+	// Whether the socket file should be removed when this process exits. Not the case for sockets from systemd,
+	// or once they have been handed off to a new process.
+	owned bool
+}
+
+// Repeatable flag holding listener specs.
+type listenSpecs []string
+
+func (ls *listenSpecs) String() string {
+	return strings.Join(*ls, " ")
+}
+
+func (ls *listenSpecs) Set(spec string) error {
+	*ls = append(*ls, spec)
+	return nil
+}
+
+// Opens a listener from a spec of the form kind:address[,option=value...], e.g.
+//
+//	unix:/dev/shm/hiveinterpreter.sock,mode=0660,owner=www-data,group=www-data,policy=internal
+//	tcp:0.0.0.0:8080,policy=public,rate=20,burst=40
+//	tls:0.0.0.0:443,cert=/etc/ssl/fullchain.pem,key=/etc/ssl/privkey.pem,policy=public
+//
+// An optional name=... option identifies the listener when it is inherited from systemd or a previous process.
+func openListener(spec string) (*serveListener, error) {
+	fields := strings.Split(spec, ",")
+	kind, addr, ok := strings.Cut(fields[0], ":")
+	if !ok || addr == "" {
+		return nil, errors.New("listener spec must start with unix:, tcp: or tls:, got " + spec)
+	}
+	opts := make(map[string]string)
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, errors.New("bad listener option " + f + " in " + spec)
+		}
+		opts[k] = v
+	}
+
+	policy, err := policyFromOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	name := opts["name"]
+	if name == "" {
+		name = addr
+	}
+
+	var sl *serveListener
+	switch kind {
+	case "unix":
+		mode := os.FileMode(0660)
+		if m, ok := opts["mode"]; ok {
+			pm, err := strconv.ParseUint(m, 8, 32)
+			if err != nil {
+				return nil, errors.New("bad mode " + m + " in " + spec)
+			}
+			mode = os.FileMode(pm)
+		}
+		sl, err = listenUnix(addr, name, mode, opts["owner"], opts["group"])
+	case "tcp", "tls":
+		sl, err = listenTCP(addr, name)
+		if err == nil && kind == "tls" {
+			sl.certs, err = newCertReloader(opts["cert"], opts["key"])
+			if err != nil {
+				sl.Close()
+			}
+		}
+	default:
+		return nil, errors.New("unknown listener kind " + kind + " in " + spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sl.policy = policy
+	return sl, nil
+}
+
+// Listens on a unix socket, taking over an inherited socket for the same path if there is one.
+// A blank owner or group leaves that unchanged.
+func listenUnix(path string, name string, mode os.FileMode, owner string, group string) (*serveListener, error) {
+	if l, ok := takeInherited(name, path); ok {
+		log.Println("Serving on inherited socket", path)
+		return &serveListener{Listener: l, name: name, path: path, owned: inheritedOwned}, nil
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is removed explicitly on exit, and must survive closing the listener after a handoff.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	sl := &serveListener{Listener: l, name: name, path: path, owned: true}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			sl.Close()
+			sl.cleanup()
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		sl.Close()
+		sl.cleanup()
+		return nil, err
+	}
+	return sl, nil
+}
+
+// Listens on a TCP address, taking over an inherited socket for the same address if there is one.
+func listenTCP(addr string, name string) (*serveListener, error) {
+	if l, ok := takeInherited(name, addr); ok {
+		log.Println("Serving on inherited socket", addr)
+		return &serveListener{Listener: l, name: name}, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &serveListener{Listener: l, name: name}, nil
+}
+
+// Removes the socket file, if this process is responsible for it.
+func (sl *serveListener) cleanup() {
+	if !sl.owned || sl.path == "" {
+		return
+	}
+	if err := os.Remove(sl.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println(err)
+	}
+}
+
+// How often a TLS listener checks whether its certificate files have changed.
+const certCheckInterval = 10 * time.Second
+
+// Serves a TLS certificate, reloading it whenever the files are replaced (e.g. on renewal).
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls listeners need both cert= and key=")
+	}
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Latest modification time of the certificate and key.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	ci, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ki, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ki.ModTime().After(ci.ModTime()) {
+		return ki.ModTime(), nil
+	}
+	return ci.ModTime(), nil
+}
+
+// Loads the key pair. Must be called with mu held, or before the reloader is shared.
+func (c *certReloader) reload() error {
+	mt, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", c.certFile, err)
+	}
+	c.cert = &cert
+	c.modTime = mt
+	c.checked = time.Now()
+	return nil
+}
+
+// For tls.Config.GetCertificate. Keeps serving the previous certificate if a reload fails.
+func (c *certReloader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > certCheckInterval {
+		c.checked = time.Now()
+		if mt, err := c.filesModTime(); err == nil && !mt.Equal(c.modTime) {
+			if err := c.reload(); err != nil {
+				log.Println("Certificate reload failed:", err)
+			} else {
+				log.Println("Reloaded certificate", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
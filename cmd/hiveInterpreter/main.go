@@ -4,7 +4,6 @@ import (
 	"flag"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"time"
@@ -27,6 +26,10 @@ var jsonit = jsoniter.Config{
 
 var debug bool
 var respcache *cache.Cache
+
+// Default time to cache responses for.
+const respCacheTime = 3 * time.Second
+
 var workers int
 
 var fullep string
@@ -38,22 +41,46 @@ var ep2pool map[string]jobPool
 
 func main() {
 	dptr := flag.Bool("d", false, "Debug mode")
-	wptr := flag.Int("w", 64, "Worker threads")
-	qptr := flag.Int("q", 8, "Per worker queue size per upstream.")
+	wptr := flag.Int("w", 64, "Worker threads per upstream: the most concurrent requests the adaptive limit may allow.")
+	flag.Int("q", 8, "Deprecated, has no effect: queueing is bounded by -m.")
+	mptr := flag.Duration("m", time.Second, "Longest a request waits for an upstream's concurrency limit before failing with 504.")
 	cptr := flag.String("c", "http://127.0.0.1:8080", "Upstream: lite. Should use unix upstream: unix:/dev/shm/hived.sock")
 	fptr := flag.String("f", "http://127.0.0.1:8090", "Upstream: full/default.")
 	hptr := flag.String("h", "", "Upstream: hivemind. Blank to disable.")
 	pptr := flag.String("p", "", "Upstream: Push transaction. Blank to be equal to light upstream.")
-	lptr := flag.String("l", "/dev/shm/hiveinterpreter.sock", "Listen sock location.")
+	u2ptr := flag.Bool("2", false, "Negotiate HTTP/2 with https upstreams. Cleartext upstreams opt in to h2c with an h2c:// location.")
+	lptr := flag.String("l", "/dev/shm/hiveinterpreter.sock", "Listen sock location. Used when no -L listeners are given.")
+	var listenFlags listenSpecs
+	flag.Var(&listenFlags, "L", "Listener, may be repeated: unix:path|tcp:addr|tls:addr followed by options, e.g. tcp:0.0.0.0:8080,policy=public")
+	rptr := flag.Float64("r", 50, "Requests per second allowed per client on public listeners.")
+	bptr := flag.Int("b", 10, "Request burst allowed per client on public listeners.")
+	pfptr := flag.String("P", "", "Json file of priority classes and method classes, over the defaults.")
+	zptr := flag.String("z", "gzip", "Encoding for large cache entries: gzip or zstd. Clients accepting it are served them without recompressing.")
+	sptr := flag.Duration("s", 30*time.Second, "Deadline for draining in-flight requests on shutdown.")
+	gptr := flag.Bool("g", false, "Serve GraphQL queries at /graphql.")
 	flag.Parse()
 	debug = *dptr
 	fullep = *fptr
 	pushep = *pptr
 	liteep = *cptr
 	hiveep = *hptr
+	upstreamH2 = *u2ptr
 	workers = *wptr
-	wQueue := *qptr
+	maxQueueWait = *mptr
 	listensock := *lptr
+	drainDeadline := *sptr
+	publicRate = *rptr
+	publicBurst = *bptr
+	cacheEncoding = *zptr
+	if cacheEncoding != "gzip" && cacheEncoding != "zstd" {
+		log.Fatal("Unknown cache encoding ", cacheEncoding)
+	}
+
+	if *pfptr != "" {
+		if err := loadPriorityFile(*pfptr); err != nil {
+			log.Fatal("Priority file: ", err)
+		}
+	}
 
 	// Create a separate worker queue for pushing regardless of if it is the same as the lite pool.
 	var pushepDst string
@@ -65,40 +92,59 @@ func main() {
 	}
 
 	// Set up cache.
-	respcache = cache.New(3*time.Second, 2*time.Minute)
+	respcache = cache.New(respCacheTime, 2*time.Minute)
+	rawcache = cache.New(rawCacheTime, 2*time.Minute)
 
 	// Set up logging.
 	f, err := os.OpenFile("hiveinterpreter.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Println(err)
 	}
-	defer f.Close()
 	wrt := io.MultiWriter(os.Stdout, f)
 	log.SetOutput(wrt)
 
-	// Set up unix socket listener.
-	os.Remove(listensock)
-	unixListener, err := net.Listen("unix", listensock)
-	if err != nil {
-		log.Fatal("Listen (UNIX socket): ", err)
-	}
-	if err := os.Chmod(listensock, 0777); err != nil {
+	// Set up listeners, reusing sockets passed in by systemd or a previous process if there are any.
+	if err := loadInheritedListeners(); err != nil {
 		log.Fatal(err)
 	}
-	defer unixListener.Close()
+	var listeners []*serveListener
+	if len(listenFlags) == 0 {
+		unixListener, err := listenUnix(listensock, listensock, 0777, "", "")
+		if err != nil {
+			log.Fatal("Listen (UNIX socket): ", err)
+		}
+		unixListener.policy, _ = policyFromOptions(map[string]string{"policy": "internal"})
+		listeners = append(listeners, unixListener)
+	}
+	for _, spec := range listenFlags {
+		sl, err := openListener(spec)
+		if err != nil {
+			log.Fatal("Listen: ", err)
+		}
+		listeners = append(listeners, sl)
+	}
 
 	// Set up upstreams.
 	ep2pool = make(map[string]jobPool)
-	ep2pool[fullep] = jobPool{initJobPool(workers, workers*wQueue), upstreamBuilder(fullep, "POST")}
-	ep2pool[liteep] = jobPool{initJobPool(workers, workers*wQueue), upstreamBuilder(liteep, "POST")}
-	ep2pool[hiveep] = jobPool{initJobPool(workers, workers*wQueue), upstreamBuilder(hiveep, "POST")}
-	ep2pool[pushep] = jobPool{initJobPool(workers, workers*wQueue), upstreamBuilder(pushepDst, "POST")}
+	ep2pool[fullep] = initJobPool(workers, upstreamBuilder(fullep, "POST"))
+	ep2pool[liteep] = initJobPool(workers, upstreamBuilder(liteep, "POST"))
+	ep2pool[hiveep] = initJobPool(workers, upstreamBuilder(hiveep, "POST"))
+	ep2pool[pushep] = initJobPool(workers, upstreamBuilder(pushepDst, "POST"))
 
-	// Handle incoming http requests.
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { doHandleReg(w, r) })
-	http.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) { doHandleREST(w, r) })
+	// Follow the head block, for handlers that need the current chain state.
+	head.start()
+	startHeadStateRefresher()
 
-	if err := http.Serve(unixListener, nil); err != nil {
-		log.Fatal(err)
+	// Handle incoming http requests.
+	http.HandleFunc("/", compressHandler(recoverHandler(doHandleReg)))
+	http.HandleFunc("/rpc", compressHandler(recoverHandler(doHandleGetRPC)))
+	http.HandleFunc("/v1/", compressHandler(recoverHandler(doHandleREST)))
+	http.HandleFunc("/v1/stream/", recoverHandler(doHandleStream))
+	http.HandleFunc("/v1/openapi.json", compressHandler(recoverHandler(doHandleOpenAPI)))
+	http.HandleFunc("/v2/", compressHandler(recoverHandler(doHandleV2)))
+	if *gptr {
+		http.HandleFunc("/graphql", compressHandler(recoverHandler(doHandleGraphQL)))
 	}
+
+	os.Exit(serveUntilSignalled(http.DefaultServeMux, listeners, drainDeadline, f))
 }
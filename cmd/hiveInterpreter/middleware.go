@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	runtimedebug "runtime/debug"
+)
+
+// Json RPC internal error, written when a handler panics.
+var internalErrorJson = []byte(`{"jsonrpc":"2.0","error":{"code":-32603,"message":"Internal error"},"id":null}` + "\n")
+
+// Wraps a handler so that a panic while serving a single request is logged with its stack and
+// reported to the client as a json RPC internal error, rather than killing the connection.
+func recoverHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			log.Println("Recovered panic serving", r.Method, r.URL.String()+":", rec)
+			log.Println(string(runtimedebug.Stack()))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(internalErrorJson)
+		}()
+		h(w, r)
+	}
+}
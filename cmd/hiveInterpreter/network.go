@@ -24,11 +24,38 @@ type httpJob struct {
 	responseJson **[]byte
 	wg           *sync.WaitGroup
 	StatusCode   *int
+	// If set, the response body is passed to sink as it arrives rather than read into responseJson.
+	sink func(status int, body io.Reader)
+	// Time until the upstream's response headers arrived.
+	latency *time.Duration
+	// The request the job is for, and when it was queued. Jobs for requests that are gone are dropped.
+	ctx      context.Context
+	enqueued time.Time
+	dropped  *bool
 }
 
 type jobPool struct {
-	jobs   chan httpJob
-	client *clientObject
+	jobs    chan httpJob
+	client  *clientObject
+	workers *sync.WaitGroup
+	limiter *adaptiveLimiter
+}
+
+// Whether to negotiate HTTP/2 with https upstreams. Those that do not speak it are still spoken to with HTTP/1.1.
+var upstreamH2 bool
+
+// Scheme of upstreams spoken to with cleartext HTTP/2 (h2c, with prior knowledge), e.g. h2c://127.0.0.1:8080 or h2c://unix:/path.
+// Only for upstreams known to speak it, as there is no fallback to HTTP/1.1.
+const h2cScheme = "h2c://"
+
+// Protocols for an upstream transport. Nil leaves the transport default (HTTP/1.1, or HTTP/2 when negotiated over TLS).
+func upstreamProtocols(h2c bool) *http.Protocols {
+	if !h2c {
+		return nil
+	}
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	return p
 }
 
 // Takes a string argument with standard http location or a unix sock, and packs it into an object to be used in a standard way.
@@ -38,6 +65,10 @@ func upstreamBuilder(location string, method_type string) (clientob *clientObjec
 	if location == "" {
 		return nil
 	}
+	h2c := strings.HasPrefix(location, h2cScheme)
+	if h2c {
+		location = "http://" + strings.TrimPrefix(location, h2cScheme)
+	}
 	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
 		location = "http://" + location
 	}
@@ -55,6 +86,7 @@ func upstreamBuilder(location string, method_type string) (clientob *clientObjec
 					}
 					return nc, err
 				},
+				Protocols: upstreamProtocols(h2c),
 			},
 		}
 		clientob.url = "http://unix"
@@ -68,6 +100,8 @@ func upstreamBuilder(location string, method_type string) (clientob *clientObjec
 				IdleConnTimeout:     30 * time.Second,
 				MaxIdleConnsPerHost: 10000,
 				DisableKeepAlives:   false,
+				ForceAttemptHTTP2:   upstreamH2 && strings.HasPrefix(location, "https://"),
+				Protocols:           upstreamProtocols(h2c),
 			},
 		}
 		clientob.url = location
@@ -75,49 +109,54 @@ func upstreamBuilder(location string, method_type string) (clientob *clientObjec
 	return clientob
 }
 
-// Main request handler. Takes a request, sends it to the worker pool, and returns the response. This unmarshals the response into a map.
-func requestToResponse(jobp jobPool, reqmessage map[string]interface{}) (int, map[string]interface{}) {
-	// Pack request as json.
+// Main request handler. Takes a request, sends it to the worker pool, and decodes the result into out.
+// Transport failures are returned as a *statusError, and upstream errors as the *rpcError from the response.
+func requestToResult(ctx context.Context, jobp jobPool, reqmessage map[string]interface{}, out interface{}) error {
+	method, _ := reqmessage["method"].(string)
+	ctx = internalJobContext(ctx, method)
 	requestJson, err := jsonit.Marshal(reqmessage)
 	if err != nil {
-		log.Println("Couldn't re-marshal request")
+		log.Println("Couldn't marshal request")
 		log.Println(err)
-		return http.StatusBadRequest, nil
+		return newStatusError(http.StatusBadRequest, "")
 	}
 
-	status, respj := requestToResponseBytes(jobp, requestJson)
+	status, respj := requestToResponseBytes(ctx, jobp, requestJson)
 	if status != http.StatusOK {
-		return status, nil
+		return newStatusError(status, "")
 	}
 
-	// Convert reply to json.
-	var rm map[string]interface{}
-	err = jsonit.Unmarshal(respj, &rm)
-	if err != nil {
+	var resp rpcResponse
+	if err := jsonit.Unmarshal(respj, &resp); err != nil {
 		log.Println("Couldn't match response type")
-		log.Println(respj)
+		log.Println(string(respj))
 		log.Println(err)
-		return http.StatusBadRequest, nil
+		return newStatusError(http.StatusBadGateway, "")
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" {
+		return newStatusError(http.StatusNotFound, "")
 	}
-	return http.StatusOK, rm
+	if err := jsonit.Unmarshal(resp.Result, out); err != nil {
+		log.Println("Couldn't match result type of", reqmessage["method"])
+		log.Println(err)
+		return newStatusError(http.StatusBadGateway, "")
+	}
+	return nil
 }
 
 // Helper function to send a request to the worker pool and return the raw response in bytes.
-func requestToResponseBytes(jobp jobPool, requestJson []byte) (int, []byte) {
+func requestToResponseBytes(ctx context.Context, jobp jobPool, requestJson []byte) (int, []byte) {
 	// Push request job to worker pool.
 	status := int(0)
 	var rawbytes []byte
 	rawbytesPtr := &rawbytes
-	var wg sync.WaitGroup
-	wg.Add(1)
-	job := httpJob{target: jobp.client, requestJson: &requestJson, wg: &wg, responseJson: &rawbytesPtr, StatusCode: &status}
-	select {
-	case jobp.jobs <- job: // insert job if buffer not full
-	default: // job buffer full
-		wg.Done()
-		return http.StatusGatewayTimeout, nil
+	job := httpJob{target: jobp.client, requestJson: &requestJson, responseJson: &rawbytesPtr, StatusCode: &status}
+	if status := jobp.run(ctx, job); status != 0 {
+		return status, nil
 	}
-	wg.Wait()
 
 	if len(**job.responseJson) == 0 {
 		log.Println("Bad (empty) response from upstream: " + (*(jobp.client)).url)
@@ -126,18 +165,75 @@ func requestToResponseBytes(jobp jobPool, requestJson []byte) (int, []byte) {
 	return status, **job.responseJson
 }
 
-// Initialize worker pool.
-func initJobPool(numWorkers int, poolSize int) chan httpJob {
+// Sends a request to the worker pool, streaming the response to sink from the worker.
+// Returns the upstream status, or an error status if the request never reached sink.
+func requestToSink(ctx context.Context, jobp jobPool, requestJson []byte, sink func(status int, body io.Reader)) int {
+	status := int(0)
+	job := httpJob{target: jobp.client, requestJson: &requestJson, StatusCode: &status, sink: sink}
+	if status := jobp.run(ctx, job); status != 0 {
+		return status
+	}
+
+	if status == 0 {
+		log.Println("No response from upstream: " + (*(jobp.client)).url)
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// Runs a job on the pool once the upstream's concurrency limit allows, and waits for it.
+// Waiting jobs are let through by the priority class and client they are tagged with in ctx.
+// Returns 0 if the job ran, or the status to fail it with if it was shed or dropped.
+func (jobp jobPool) run(ctx context.Context, job httpJob) int {
+	enqueued := time.Now()
+	if status := jobp.limiter.acquire(ctx, jobTagOf(ctx), enqueued); status != 0 {
+		return status
+	}
+	var wg sync.WaitGroup
+	var latency time.Duration
+	var dropped bool
+	wg.Add(1)
+	job.wg = &wg
+	job.latency = &latency
+	job.ctx = ctx
+	job.enqueued = enqueued
+	job.dropped = &dropped
+	jobp.jobs <- job
+	wg.Wait()
+	status := *job.StatusCode
+	jobp.limiter.release(latency, status == 0 || status >= 500, !dropped)
+	if dropped {
+		return http.StatusGatewayTimeout
+	}
+	return 0
+}
+
+// Initialize worker pool. The workers bound the concurrency the pool's limiter may allow.
+func initJobPool(numWorkers int, client *clientObject) jobPool {
 	// Create and launch job worker pool
-	jobs := make(chan httpJob, poolSize)
+	jobs := make(chan httpJob, numWorkers)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
 	for i := 1; i <= numWorkers; i++ {
 		go func(i int) {
+			defer wg.Done()
 			for j := range jobs {
 				doJob(i, j)
 			}
 		}(i)
 	}
-	return jobs
+	name := ""
+	if client != nil {
+		name = client.url
+	}
+	return jobPool{jobs: jobs, client: client, workers: &wg, limiter: newAdaptiveLimiter(name, numWorkers)}
+}
+
+// Stops the pool from taking new jobs, and waits for the queued and running jobs to finish.
+// Must only be called once nothing else will submit jobs to the pool.
+func (jobp jobPool) drain(ctx context.Context) error {
+	close(jobp.jobs)
+	return waitGroupContext(ctx, jobp.workers)
 }
 
 // Job loop for a worker thread: make request to upstream, return raw response.
@@ -145,13 +241,21 @@ func doJob(id int, j httpJob) {
 	defer j.wg.Done()
 	clientob := *j.target
 
+	// Last check before the upstream is asked: the client may have gone while the job waited.
+	if j.ctx.Err() != nil || time.Since(j.enqueued) > maxQueueWait {
+		*j.dropped = true
+		return
+	}
+
 	req, err := http.NewRequest(clientob.method_type, clientob.url, bytes.NewBuffer(*j.requestJson))
 	if err != nil {
 		return
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
 	resp, err := clientob.client.Do(req)
+	*j.latency = time.Since(start)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -160,9 +264,13 @@ func doJob(id int, j httpJob) {
 	}
 
 	*j.StatusCode = resp.StatusCode
-	**j.responseJson, err = io.ReadAll(resp.Body)
-	if err != nil {
-		log.Println(err)
+	if j.sink != nil {
+		j.sink(resp.StatusCode, resp.Body)
+	} else {
+		**j.responseJson, err = io.ReadAll(resp.Body)
+		if err != nil {
+			log.Println(err)
+		}
 	}
 	_, err = io.Copy(io.Discard, resp.Body)
 	if err != nil {
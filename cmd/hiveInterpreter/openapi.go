@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var openAPIDoc struct {
+	once sync.Once
+	body []byte
+}
+
+// Serves an OpenAPI 3 document of the REST interface, generated from the same schemas that type its parameters.
+func doHandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIDoc.once.Do(func() {
+		var err error
+		if openAPIDoc.body, err = json.MarshalIndent(buildOpenAPI(), "", "  "); err != nil {
+			log.Println("Couldn't marshal OpenAPI document:", err)
+		}
+	})
+	if openAPIDoc.body == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(openAPIDoc.body)
+}
+
+func buildOpenAPI() map[string]interface{} {
+	paths := make(map[string]interface{})
+	for method, m := range restSchemas {
+		api, name, _ := strings.Cut(method, ".")
+		resp := jsonResponse(m.example)
+		paths["/v1/"+api+"/"+name] = openAPIOperation(method, api, "", withTable(method, withPaging(method, withFields(m.params)), resp), nil, resp)
+	}
+	for name, sig := range condenserSignatures {
+		method := "condenser_api." + name
+		resp := jsonResponse(sig.example)
+		paths["/v1/condenser_api/"+name] = openAPIOperation(method, "condenser_api", "", withTable(method, withPaging(method, withFields(sig.params)), resp), nil, resp)
+	}
+	for name, ext := range restExtensions {
+		resp := jsonResponse(ext.example)
+		if ext.text {
+			resp = map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}, "example": ext.example}}
+		}
+		paths["/v1/"+ext.api+"/"+name] = openAPIOperation(ext.api+"."+name, ext.api, ext.desc, ext.params, nil, resp)
+	}
+	for _, route := range v2Routes {
+		var pathParams []string
+		for _, seg := range strings.Split(route.path, "/") {
+			if strings.HasPrefix(seg, "{") {
+				pathParams = append(pathParams, strings.Trim(seg, "{}"))
+			}
+		}
+		id := "v2." + strings.NewReplacer("/", ".", "{", "", "}", "").Replace(route.path)
+		params := withFields(route.params)
+		if len(route.keys) > 0 {
+			params = append(params, cursorRestParam)
+		}
+		paths["/v2/"+route.path] = openAPIOperation(id, "v2", route.desc, params, pathParams, v2Example(route.example))
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "HiveInterpreter REST API",
+			"version":     "1",
+			"description": "REST access to the Hive json RPC APIs. /v1 paths are api/method, with the params given as query values; /v2 paths are resources.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"v2Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"error": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"status":  map[string]interface{}{"type": "integer"},
+								"message": map[string]interface{}{"type": "string"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// Params that shape the response rather than the call, so are only taken from the query.
+var queryOnlyParams = map[string]bool{fieldsParam: true, cursorParam: true, formatParam: true, columnsParam: true}
+
+// Adds the projection parameter to those of a method.
+func withFields(params []restParam) []restParam {
+	return append(params[:len(params):len(params)], fieldsRestParam)
+}
+
+// Adds the cursor parameter to those of a paged method.
+func withPaging(method string, params []restParam) []restParam {
+	if _, ok := restPagers[method]; ok {
+		return append(params, cursorRestParam)
+	}
+	return params
+}
+
+// Adds the output format parameters to those of a method with a list result, and their media types to its response.
+func withTable(method string, params []restParam, content map[string]interface{}) []restParam {
+	if _, ok := restTables[method]; !ok {
+		return params
+	}
+	text := map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+	content["text/csv"] = text
+	content["application/x-ndjson"] = text
+	return append(params, formatRestParam, columnsRestParam)
+}
+
+// A path item with a GET operation and, for /v1, a POST taking the params as a json body.
+func openAPIOperation(id string, tag string, summary string, params []restParam, pathParams []string, content map[string]interface{}) map[string]interface{} {
+	parameters := []interface{}{}
+	for _, name := range pathParams {
+		parameters = append(parameters, map[string]interface{}{
+			"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, p := range params {
+		param := map[string]interface{}{"name": p.name, "in": "query", "required": p.required, "schema": openAPISchema(p)}
+		if p.desc != "" {
+			param["description"] = p.desc
+		}
+		parameters = append(parameters, param)
+	}
+
+	badRequest := map[string]interface{}{"description": "Bad, missing or unknown parameters"}
+	if tag == "v2" {
+		badRequest["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/v2Error"}}}
+	} else {
+		badRequest["content"] = map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	}
+	op := map[string]interface{}{
+		"operationId": id,
+		"tags":        []string{tag},
+		"parameters":  parameters,
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{"description": "The result", "content": content},
+			"400": badRequest,
+		},
+	}
+	if summary != "" {
+		op["summary"] = summary
+	}
+	if tag == "v2" {
+		return map[string]interface{}{"get": op}
+	}
+
+	// /v1 params may instead be posted as a json object, in which case none are needed in the query.
+	properties := make(map[string]interface{}, len(params))
+	required := []string{}
+	postParams := make([]interface{}, 0, len(parameters))
+	for _, p := range params {
+		if !queryOnlyParams[p.name] {
+			properties[p.name] = openAPISchema(p)
+			if p.required {
+				required = append(required, p.name)
+			}
+		}
+		postParams = append(postParams, map[string]interface{}{"name": p.name, "in": "query", "required": false, "schema": openAPISchema(p)})
+	}
+	body := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		body["required"] = required
+	}
+	post := make(map[string]interface{}, len(op)+1)
+	for k, v := range op {
+		post[k] = v
+	}
+	post["operationId"] = id + ".post"
+	post["parameters"] = postParams
+	post["requestBody"] = map[string]interface{}{
+		"description": "Params as a json object, merged with those in the query. Each may be given in only one of them.",
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": body}},
+	}
+	return map[string]interface{}{"get": op, "post": post}
+}
+
+// The schema of a parameter's query value.
+func openAPISchema(p restParam) map[string]interface{} {
+	schema := map[string]interface{}{"type": p.kind}
+	switch p.kind {
+	case paramInteger:
+		schema["format"] = "int64"
+	case paramJSON:
+		// Any value, given as json.
+		schema = map[string]interface{}{}
+	}
+	if p.enum != nil {
+		schema["enum"] = p.enum
+	}
+	if p.max != 0 {
+		schema["minimum"] = p.min
+		schema["maximum"] = p.max
+	}
+	if p.array {
+		schema = map[string]interface{}{"type": "array", "items": schema}
+	}
+	if p.def != nil {
+		schema["default"] = p.def
+	}
+	return schema
+}
+
+// Responses of /v1 methods are json objects: the result if it is one, otherwise {"result": ...}.
+func jsonResponse(example string) map[string]interface{} {
+	media := map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}
+	if example != "" {
+		media["example"] = json.RawMessage(example)
+	}
+	return map[string]interface{}{"application/json": media}
+}
+
+func v2Example(example string) map[string]interface{} {
+	media := map[string]interface{}{"schema": map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"data": map[string]interface{}{}},
+	}}
+	if example != "" {
+		media["example"] = json.RawMessage(`{"data": ` + example + `}`)
+	}
+	return map[string]interface{}{"application/json": media}
+}
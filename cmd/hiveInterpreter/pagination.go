@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Name of the REST query parameter giving the cursor of a page.
+const cursorParam = "cursor"
+
+// The REST query parameter, for the API document.
+var cursorRestParam = restParam{name: cursorParam, kind: paramString,
+	desc: "Cursor of the page to get, from the next link of the previous page (the Link header, or next on /v2)."}
+
+// Largest page the nodes list.
+const maxPageLimit = 1000
+
+// Where a page of a listing starts, beyond the query it was first asked with. Cursors are opaque to clients: they
+// are taken from the next link of a page, and only valid with the query they were made for.
+type restCursor struct {
+	Hash   string                 `json:"h"`
+	Params map[string]interface{} `json:"p"`
+	// The page starts with the last item of the previous one, which is dropped.
+	Skip bool `json:"s,omitempty"`
+}
+
+func (c *restCursor) encode() string {
+	b, _ := jsonit.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Decodes a cursor given with a query, which must be the one it was made for.
+func decodeCursor(s string, hash string) (*restCursor, error) {
+	bad := newStatusError(http.StatusBadRequest, "Bad cursor")
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, bad
+	}
+	var c restCursor
+	if err := jsonit.Unmarshal(b, &c); err != nil {
+		return nil, bad
+	}
+	if c.Hash != hash {
+		return nil, newStatusError(http.StatusBadRequest, "Cursor is for a different query")
+	}
+	return &c, nil
+}
+
+// Identifies a listing query, without its cursor, so that a cursor cannot be used with another.
+func cursorHash(scope string, q url.Values) string {
+	q2 := url.Values{}
+	for k, v := range q {
+		if k != cursorParam && k != fieldsParam {
+			q2[k] = v
+		}
+	}
+	sum := sha256.Sum256([]byte(scope + "?" + q2.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// How a REST listing is paged: its items, and the params of the page after them.
+type restPager struct {
+	// Field of the result holding the items, or "" if the result is the list.
+	items string
+	// Params a cursor may set.
+	keys []string
+	// Fills in params for the first page.
+	first func(named map[string]interface{}, method string) error
+	// The params of the page after one with the given items, or nil if it was the last. With skip, the next page
+	// starts with the last of these items.
+	next func(named map[string]interface{}, items []json.RawMessage) (params map[string]interface{}, skip bool)
+}
+
+var restPagers = map[string]restPager{
+	"database_api.list_accounts":              {items: "accounts", keys: []string{"start"}, first: orderedFirst(accountPageOrders), next: orderedNext(accountPageOrders)},
+	"database_api.list_witnesses":             {items: "witnesses", keys: []string{"start"}, first: orderedFirst(witnessPageOrders), next: orderedNext(witnessPageOrders)},
+	"database_api.list_proposals":             {items: "proposals", keys: []string{"start", "last_id"}, next: proposalNext},
+	"account_history_api.get_account_history": {items: "history", keys: []string{"start", "limit"}, next: historyNext},
+	"condenser_api.get_account_history":       {keys: []string{"start", "limit"}, next: historyNext},
+}
+
+// How a listing in some order starts, and the fields of an item that make up its start key.
+type pageOrder struct {
+	fields []string
+	first  interface{} // Start of the first page, or nil if it must be given.
+}
+
+var accountPageOrders = map[string]pageOrder{
+	"by_name":                    {fields: []string{"name"}, first: ""},
+	"by_proxy":                   {fields: []string{"proxy", "name"}, first: []interface{}{"", ""}},
+	"by_next_vesting_withdrawal": {fields: []string{"next_vesting_withdrawal", "name"}, first: []interface{}{"1970-01-01T00:00:00", ""}},
+}
+
+var witnessPageOrders = map[string]pageOrder{
+	"by_name":          {fields: []string{"owner"}, first: ""},
+	"by_vote_name":     {fields: []string{"votes", "owner"}},
+	"by_schedule_time": {fields: []string{"virtual_scheduled_time", "owner"}},
+}
+
+// Fields of a proposal that its start key is made of, by order.
+var proposalPageOrders = map[string]string{
+	"by_creator":     "creator",
+	"by_start_date":  "start_date",
+	"by_end_date":    "end_date",
+	"by_total_votes": "total_votes",
+}
+
+func orderedFirst(orders map[string]pageOrder) func(map[string]interface{}, string) error {
+	return func(named map[string]interface{}, method string) error {
+		if _, ok := named["start"]; ok {
+			return nil
+		}
+		order, _ := named["order"].(string)
+		first := orders[order].first
+		if first == nil {
+			return newStatusError(http.StatusBadRequest, "Missing parameter \"start\" for "+method+" with order "+order)
+		}
+		named["start"] = first
+		return nil
+	}
+}
+
+// Orders whose start is inclusive continue from the key of the last item.
+func orderedNext(orders map[string]pageOrder) func(map[string]interface{}, []json.RawMessage) (map[string]interface{}, bool) {
+	return func(named map[string]interface{}, items []json.RawMessage) (map[string]interface{}, bool) {
+		if len(items) == 0 || int64(len(items)) < namedInt(named, "limit") {
+			return nil, false
+		}
+		order, _ := named["order"].(string)
+		fields := orders[order].fields
+		var last map[string]json.RawMessage
+		if len(fields) == 0 || jsonit.Unmarshal(items[len(items)-1], &last) != nil {
+			return nil, false
+		}
+		key := make([]json.RawMessage, 0, len(fields))
+		for _, f := range fields {
+			v, ok := last[f]
+			if !ok {
+				return nil, false
+			}
+			key = append(key, v)
+		}
+		if len(key) == 1 {
+			return map[string]interface{}{"start": key[0]}, true
+		}
+		return map[string]interface{}{"start": key}, true
+	}
+}
+
+// Proposals continue after the id of the last one.
+func proposalNext(named map[string]interface{}, items []json.RawMessage) (map[string]interface{}, bool) {
+	if len(items) == 0 || int64(len(items)) < namedInt(named, "limit") {
+		return nil, false
+	}
+	order, _ := named["order"].(string)
+	var last map[string]json.RawMessage
+	if jsonit.Unmarshal(items[len(items)-1], &last) != nil {
+		return nil, false
+	}
+	key, kok := last[proposalPageOrders[order]]
+	id, iok := last["id"]
+	if !kok || !iok {
+		return nil, false
+	}
+	return map[string]interface{}{"start": []json.RawMessage{key}, "last_id": id}, false
+}
+
+// History is listed backwards, in pages ending at start, so continues before the first item.
+func historyNext(named map[string]interface{}, items []json.RawMessage) (map[string]interface{}, bool) {
+	if len(items) == 0 {
+		return nil, false
+	}
+	var first [2]json.RawMessage
+	if jsonit.Unmarshal(items[0], &first) != nil {
+		return nil, false
+	}
+	seq, err := strconv.ParseInt(string(first[0]), 10, 64)
+	if err != nil || seq <= 0 {
+		return nil, false
+	}
+	// The node needs the limit to be no more than start+1.
+	limit := namedInt(named, "limit")
+	if limit > seq {
+		limit = seq
+	}
+	return map[string]interface{}{"start": seq - 1, "limit": limit}, false
+}
+
+// An integer param, or 0.
+func namedInt(named map[string]interface{}, name string) int64 {
+	n, _ := MaybeGetInt64(named[name])
+	return n
+}
+
+// Sets the params of a page: from its cursor, or for the first page.
+func (pg restPager) prepare(named map[string]interface{}, cursor *restCursor, method string) error {
+	if cursor == nil {
+		if pg.first != nil {
+			return pg.first(named, method)
+		}
+		return nil
+	}
+	for k, v := range cursor.Params {
+		allowed := false
+		for _, key := range pg.keys {
+			allowed = allowed || key == k
+		}
+		if !allowed {
+			return newStatusError(http.StatusBadRequest, "Bad cursor")
+		}
+		// A cursor may shrink a page, but not grow it past what the query asked for.
+		if k == "limit" {
+			if n, ok := MaybeGetInt64(v); !ok || (named[k] != nil && n > namedInt(named, k)) {
+				continue
+			}
+		}
+		named[k] = v
+	}
+	// Make up for the repeated item that will be dropped, within what the node allows.
+	if limit := namedInt(named, "limit"); cursor.Skip && limit > 0 && limit < maxPageLimit {
+		named["limit"] = json.Number(strconv.FormatInt(limit+1, 10))
+	}
+	return nil
+}
+
+// Pages an upstream response: drops the item repeated from the previous page, and gives the cursor of the next page,
+// or nil if it is the last. Errors are left as they are.
+func (pg restPager) page(respJson []byte, named map[string]interface{}, cursor *restCursor, hash string) ([]byte, *restCursor, error) {
+	var resp map[string]json.RawMessage
+	if err := jsonit.Unmarshal(respJson, &resp); err != nil {
+		return nil, nil, err
+	}
+	result, ok := resp["result"]
+	if !ok || string(result) == "null" {
+		return respJson, nil, nil
+	}
+	var obj map[string]json.RawMessage
+	var items []json.RawMessage
+	if pg.items == "" {
+		if err := jsonit.Unmarshal(result, &items); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if err := jsonit.Unmarshal(result, &obj); err != nil {
+			return nil, nil, err
+		}
+		if list, ok := obj[pg.items]; ok {
+			if err := jsonit.Unmarshal(list, &items); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	var next *restCursor
+	if params, skip := pg.next(named, items); params != nil {
+		next = &restCursor{Hash: hash, Params: params, Skip: skip}
+	}
+	if cursor == nil || !cursor.Skip || len(items) == 0 {
+		return respJson, next, nil
+	}
+
+	items = items[1:]
+	list, err := jsonit.Marshal(items)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pg.items == "" {
+		resp["result"] = list
+	} else {
+		obj[pg.items] = list
+		if resp["result"], err = jsonit.Marshal(obj); err != nil {
+			return nil, nil, err
+		}
+	}
+	respJson, err = jsonit.Marshal(resp)
+	return respJson, next, err
+}
+
+// The link to the page after a request's, keeping its query but for the cursor.
+func nextPageLink(r *http.Request, next *restCursor) string {
+	q := r.URL.Query()
+	q.Set(cursorParam, next.encode())
+	return r.URL.Path + "?" + q.Encode()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestHistoryPagesWithDefaults(t *testing.T) {
+	tests := []struct {
+		method string
+		resp   string
+	}{
+		{"account_history_api.get_account_history", `{"jsonrpc":"2.0","result":{"history":[[2000,{}],[2001,{}]]},"id":"0"}`},
+		{"condenser_api.get_account_history", `{"jsonrpc":"2.0","result":[[2000,{}],[2001,{}]],"id":"0"}`},
+	}
+	for _, tt := range tests {
+		pager := restPagers[tt.method]
+		q := url.Values{"account": {"alice"}}
+		hash := cursorHash(tt.method, q)
+
+		// The first page, with neither start nor limit given.
+		var cursor *restCursor
+		adjust := func(named map[string]interface{}) error { return pager.prepare(named, cursor, tt.method) }
+		_, named, err := restParams(tt.method, q, nil, adjust)
+		if err != nil {
+			t.Fatalf("%s: first page: %v", tt.method, err)
+		}
+		if start, limit := namedInt(named, "start"), namedInt(named, "limit"); start != -1 || limit != 1000 {
+			t.Errorf("%s: first page start, limit = %d, %d, want -1, 1000", tt.method, start, limit)
+		}
+		_, next, err := pager.page([]byte(tt.resp), named, nil, hash)
+		if err != nil || next == nil {
+			t.Fatalf("%s: page = %+v, %v, want a next page", tt.method, next, err)
+		}
+
+		// The next page, from the cursor as a client would give it back.
+		if cursor, err = decodeCursor(next.encode(), hash); err != nil {
+			t.Fatalf("%s: decodeCursor: %v", tt.method, err)
+		}
+		if _, named, err = restParams(tt.method, q, nil, adjust); err != nil {
+			t.Fatalf("%s: next page: %v", tt.method, err)
+		}
+		if start, limit := namedInt(named, "start"), namedInt(named, "limit"); start != 1999 || limit != 1000 {
+			t.Errorf("%s: next page start, limit = %d, %d, want 1999, 1000", tt.method, start, limit)
+		}
+	}
+}
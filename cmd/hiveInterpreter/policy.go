@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per listener behaviour. Internal listeners sit behind a trusted proxy (nginx) which does its own limiting,
+// while public listeners face clients directly.
+type listenPolicy struct {
+	name string
+	// Whether X-Real-IP / X-Forwarded-For from the peer are trusted to identify the client.
+	trustProxy bool
+	// Requests per second allowed per client, and the burst above that. Zero rate disables limiting.
+	rate    float64
+	burst   int
+	limiter *rateLimiter
+}
+
+// Default limits for public listeners, set from flags.
+var publicRate float64
+var publicBurst int
+
+type policyCtxKey struct{}
+
+// Builds the policy for a listener from its spec options: policy=internal|public, and optionally rate= and burst=.
+func policyFromOptions(opts map[string]string) (*listenPolicy, error) {
+	p := &listenPolicy{name: opts["policy"]}
+	switch p.name {
+	case "", "internal":
+		p.name = "internal"
+		p.trustProxy = true
+	case "public":
+		p.rate = publicRate
+		p.burst = publicBurst
+	default:
+		return nil, errors.New("unknown listener policy " + p.name)
+	}
+	if v, ok := opts["rate"]; ok {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, errors.New("bad rate " + v)
+		}
+		p.rate = r
+	}
+	if v, ok := opts["burst"]; ok {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("bad burst " + v)
+		}
+		p.burst = b
+	}
+	if p.rate > 0 {
+		p.limiter = newRateLimiter(p.rate, p.burst)
+	}
+	return p, nil
+}
+
+// Applies a listener's policy to each request, and makes the policy available to handlers.
+func policyHandler(p *listenPolicy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), policyCtxKey{}, p))
+		if p.limiter != nil && !p.limiter.allow(clientIdentity(r)) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// The policy of the listener a request arrived on. Requests that did not come through a listener are treated as internal.
+func requestPolicy(r *http.Request) *listenPolicy {
+	if p, ok := r.Context().Value(policyCtxKey{}).(*listenPolicy); ok {
+		return p
+	}
+	return &listenPolicy{name: "internal", trustProxy: true}
+}
+
+// Identifies the client making a request: the peer address, or the address forwarded by a trusted proxy.
+func clientIdentity(r *http.Request) string {
+	if requestPolicy(r).trustProxy {
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// How often idle client buckets are dropped from a rate limiter.
+const rateLimiterSweep = time.Minute
+
+// Token bucket rate limiter, per client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// Takes a token for the client, if one is available.
+func (rl *rateLimiter) allow(client string) bool {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateLimiterSweep {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Scheduling classes and their weights. When requests are waiting for an upstream, each class gets slots in
+// proportion to its weight, so that heavy requests cannot hold up cheap lookups or broadcasts.
+var priorityClasses = map[string]int{
+	"broadcast": 8,
+	"lookup":    4,
+	"default":   2,
+	"history":   1,
+}
+
+// Class of methods not listed in methodClasses.
+const defaultPriorityClass = "default"
+
+// Class of each method, by name without its api.
+var methodClasses = map[string]string{
+	"broadcast_transaction":                 "broadcast",
+	"broadcast_transaction_synchronous":     "broadcast",
+	"broadcast_block":                       "broadcast",
+	"get_accounts":                          "lookup",
+	"find_accounts":                         "lookup",
+	"lookup_accounts":                       "lookup",
+	"lookup_account_names":                  "lookup",
+	"find_rc_accounts":                      "lookup",
+	"get_dynamic_global_properties":         "lookup",
+	"get_config":                            "lookup",
+	"get_version":                           "lookup",
+	"get_block_header":                      "lookup",
+	"get_content":                           "lookup",
+	"get_profile":                           "lookup",
+	"get_account_history":                   "history",
+	"enum_virtual_ops":                      "history",
+	"get_block_range":                       "history",
+	"get_transaction":                       "history",
+	"get_ranked_posts":                      "history",
+	"get_account_posts":                     "history",
+	"get_discussions_by_trending":           "history",
+	"get_discussions_by_created":            "history",
+	"get_discussions_by_hot":                "history",
+	"get_discussions_by_blog":               "history",
+	"get_discussions_by_feed":               "history",
+	"get_discussions_by_comments":           "history",
+	"get_discussions_by_author_before_date": "history",
+	"get_state":                             "history",
+}
+
+// Loads classes and method classes from a json file, over the defaults:
+// {"classes": {"name": weight, ...}, "methods": {"method": "class", ...}}
+func loadPriorityFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var conf struct {
+		Classes map[string]int    `json:"classes"`
+		Methods map[string]string `json:"methods"`
+	}
+	if err := jsonit.Unmarshal(b, &conf); err != nil {
+		return err
+	}
+	for class, weight := range conf.Classes {
+		if weight < 1 {
+			return errors.New("priority class " + class + " needs a weight of at least 1")
+		}
+		priorityClasses[class] = weight
+	}
+	for method, class := range conf.Methods {
+		if _, ok := priorityClasses[class]; !ok {
+			return errors.New("unknown priority class " + class + " for " + method)
+		}
+		methodClasses[method] = class
+	}
+	return nil
+}
+
+// The class of a method, given with or without its api.
+func methodClass(method string) string {
+	if i := strings.LastIndexByte(method, '.'); i >= 0 {
+		method = method[i+1:]
+	}
+	if class, ok := methodClasses[method]; ok {
+		return class
+	}
+	return defaultPriorityClass
+}
+
+// Who a request to an upstream is for, for scheduling it.
+type jobTag struct {
+	class  string
+	client string
+}
+
+type jobTagCtxKey struct{}
+
+// Client used for requests the interpreter makes on its own behalf.
+const internalClient = "internal"
+
+// Tags a context for requests made for a client calling a method.
+func jobContext(ctx context.Context, client string, method string) context.Context {
+	return context.WithValue(ctx, jobTagCtxKey{}, jobTag{class: methodClass(method), client: client})
+}
+
+// Tags a context for the interpreter's own requests for a method, unless it is already tagged.
+func internalJobContext(ctx context.Context, method string) context.Context {
+	if _, ok := ctx.Value(jobTagCtxKey{}).(jobTag); ok {
+		return ctx
+	}
+	return jobContext(ctx, internalClient, method)
+}
+
+// The tag of a request's context. Untagged requests are the interpreter's own.
+func jobTagOf(ctx context.Context) jobTag {
+	if tag, ok := ctx.Value(jobTagCtxKey{}).(jobTag); ok {
+		return tag
+	}
+	return jobTag{class: defaultPriorityClass, client: internalClient}
+}
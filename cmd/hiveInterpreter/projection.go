@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Name of the REST query parameter, and of the json RPC request member, listing the fields of the result to send.
+const fieldsParam = "fields"
+
+// Bounds on a projection, so that it costs little more than sending the full result.
+const (
+	maxProjectionFields = 64
+	maxProjectionDepth  = 16
+)
+
+// The parts of a json value to keep, by object key or array index. A nil projection keeps the whole value.
+// Arrays are projected element by element, unless indexes are given, in which case only those elements are kept.
+type projection map[string]projection
+
+// The REST query parameter, for the API document.
+var fieldsRestParam = restParam{name: fieldsParam, kind: paramString, array: true,
+	desc: "Fields of the result to send, as dotted paths (block.witness) or json pointers (/block/witness). Arrays are projected element by element."}
+
+// Parses a list of paths, each given as a json pointer (/a/0/b) or dotted (a.0.b), and possibly comma separated.
+func parseFields(list []string) (projection, error) {
+	p := projection{}
+	n := 0
+	for _, entry := range list {
+		for _, path := range strings.Split(entry, ",") {
+			path = strings.TrimSpace(path)
+			if path == "" {
+				continue
+			}
+			segs, err := parseFieldPath(path)
+			if err != nil {
+				return nil, err
+			}
+			if n++; n > maxProjectionFields {
+				return nil, errors.New("too many fields, at most " + strconv.Itoa(maxProjectionFields))
+			}
+			p.add(segs)
+		}
+	}
+	if len(p) == 0 {
+		return nil, errors.New("no fields given")
+	}
+	return p, nil
+}
+
+// Splits a path given as a json pointer (/a/0/b) or dotted (a.0.b).
+func parseFieldPath(path string) ([]string, error) {
+	var segs []string
+	if strings.HasPrefix(path, "/") {
+		segs = strings.Split(path[1:], "/")
+		for i, s := range segs {
+			segs[i] = strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+		}
+	} else {
+		segs = strings.Split(path, ".")
+	}
+	if len(segs) > maxProjectionDepth {
+		return nil, errors.New("field " + strconv.Quote(path) + " is too deep")
+	}
+	for _, s := range segs {
+		if s == "" {
+			return nil, errors.New("bad field " + strconv.Quote(path))
+		}
+	}
+	return segs, nil
+}
+
+// Parses the fields member of a json RPC request: a list of paths, or a comma separated string of them.
+func parseFieldsMember(v interface{}) (projection, error) {
+	switch f := v.(type) {
+	case string:
+		return parseFields([]string{f})
+	case []interface{}:
+		list := make([]string, 0, len(f))
+		for _, x := range f {
+			s, ok := x.(string)
+			if !ok {
+				return nil, errors.New("fields must be strings")
+			}
+			list = append(list, s)
+		}
+		return parseFields(list)
+	}
+	return nil, errors.New("fields must be a list of strings")
+}
+
+// Adds a path. A path that is a prefix of another keeps the whole value.
+func (p projection) add(segs []string) {
+	sub, ok := p[segs[0]]
+	if len(segs) == 1 {
+		p[segs[0]] = nil
+		return
+	}
+	if ok && sub == nil {
+		return
+	}
+	if !ok {
+		sub = projection{}
+		p[segs[0]] = sub
+	}
+	sub.add(segs[1:])
+}
+
+// A canonical form, for cache keys.
+func (p projection) key() string {
+	k, _ := jsonit.Marshal(p)
+	return string(k)
+}
+
+// Applies a projection to a json value. Values that are not objects or arrays are kept as they are.
+func (p projection) apply(raw json.RawMessage) (json.RawMessage, error) {
+	if p == nil {
+		return raw, nil
+	}
+	trimmed := raw[skipSpace(raw, 0):]
+	if len(trimmed) == 0 {
+		return raw, nil
+	}
+	switch trimmed[0] {
+	case '{':
+		var obj map[string]json.RawMessage
+		if err := jsonit.Unmarshal(trimmed, &obj); err != nil {
+			return nil, err
+		}
+		out := make(map[string]json.RawMessage, len(p))
+		for k, sub := range p {
+			v, ok := obj[k]
+			if !ok {
+				continue
+			}
+			pv, err := sub.apply(v)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = pv
+		}
+		return jsonit.Marshal(out)
+	case '[':
+		var arr []json.RawMessage
+		if err := jsonit.Unmarshal(trimmed, &arr); err != nil {
+			return nil, err
+		}
+		out := make([]json.RawMessage, 0, len(arr))
+		if p.hasIndexes() {
+			for i, v := range arr {
+				sub, ok := p[strconv.Itoa(i)]
+				if !ok {
+					continue
+				}
+				pv, err := sub.apply(v)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, pv)
+			}
+			return jsonit.Marshal(out)
+		}
+		for _, v := range arr {
+			pv, err := p.apply(v)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, pv)
+		}
+		return jsonit.Marshal(out)
+	}
+	return raw, nil
+}
+
+func (p projection) hasIndexes() bool {
+	for k := range p {
+		if _, err := strconv.Atoi(k); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Projects the result of a json RPC response, leaving errors as they are.
+func projectResponse(respJson []byte, p projection) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if err := jsonit.Unmarshal(respJson, &resp); err != nil {
+		return nil, err
+	}
+	result, ok := resp["result"]
+	if !ok || string(result) == "null" {
+		return respJson, nil
+	}
+	projected, err := p.apply(result)
+	if err != nil {
+		return nil, err
+	}
+	resp["result"] = projected
+	return jsonit.Marshal(resp)
+}
+
+// Gets the projected response to a call. The full response is fetched and cached as usual, and the projection is
+// cached under its own key, except for head state, whose full entries are refreshed in place.
+func fetchProjectedResponse(ctx context.Context, call rpcCall) (int, []byte, bool) {
+	key := "fields:" + call.fields.key() + ":" + string(call.requestJson)
+	if x, found := respcache.Get(key); found {
+		if respJson, err := x.(cacheEntry).bytes(); err == nil {
+			return http.StatusOK, respJson, true
+		}
+	}
+	full := call
+	full.fields = nil
+	status, respJson, cached := fetchResponse(ctx, full)
+	if status != http.StatusOK {
+		return status, nil, false
+	}
+	projected, err := projectResponse(respJson, call.fields)
+	if err != nil {
+		return http.StatusBadGateway, nil, false
+	}
+	if !headStateMethods[call.method] {
+		respcache.Set(key, newCacheEntry(projected), cacheTTL(call))
+	}
+	return http.StatusOK, projected, cached
+}
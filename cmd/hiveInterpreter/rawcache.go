@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// How long a raw request body is remembered. Freshness is decided by respcache, so this only bounds memory.
+const rawCacheTime = 2 * time.Minute
+
+// First level cache, from a hash of a raw request body with its id masked out, to the normalized request it
+// decoded to. Lets repeated requests find their response in respcache without being decoded.
+var rawcache *cache.Cache
+
+type rawEntry struct {
+	key    string // respcache key, the normalized request.
+	method string
+}
+
+// The id used for requests that do not carry one.
+var defaultRawID = []byte(`"0"`)
+
+// A raw request body, scanned without decoding.
+type rawRequest struct {
+	key      string
+	id       []byte // Raw json of the client's id.
+	arrayreq bool
+}
+
+// Scans a request body for its id, and hashes the rest. Accepts what doHandleReg serves: a single request,
+// or a batch of one.
+func scanRawRequest(body []byte) (rawRequest, bool) {
+	var req rawRequest
+	start := skipSpace(body, 0)
+	if start < len(body) && body[start] == '[' {
+		req.arrayreq = true
+		start = skipSpace(body, start+1)
+	}
+	if start >= len(body) || body[start] != '{' {
+		return req, false
+	}
+	end, ok := skipValue(body, start)
+	if !ok {
+		return req, false
+	}
+	rest := skipSpace(body, end)
+	if req.arrayreq {
+		if rest >= len(body) || body[rest] != ']' {
+			return req, false
+		}
+		rest = skipSpace(body, rest+1)
+	}
+	if rest != len(body) {
+		return req, false
+	}
+
+	idStart, idEnd, ok := objectField(body[start:end], "id")
+	if !ok {
+		return req, false
+	}
+	h := sha256.New()
+	if req.arrayreq {
+		h.Write([]byte{'['})
+	}
+	if idStart < 0 {
+		req.id = defaultRawID
+		h.Write(body[start:end])
+	} else {
+		req.id = body[start+idStart : start+idEnd]
+		if !json.Valid(req.id) {
+			return req, false
+		}
+		h.Write(body[start : start+idStart])
+		h.Write([]byte{0})
+		h.Write(body[start+idEnd : end])
+	}
+	req.key = string(h.Sum(nil))
+	return req, true
+}
+
+// Looks up the cached response for a raw request.
+func lookupRawRequest(req rawRequest) (cacheEntry, bool) {
+	x, found := rawcache.Get(req.key)
+	if !found {
+		return cacheEntry{}, false
+	}
+	entry := x.(rawEntry)
+	resp, found := respcache.Get(entry.key)
+	if !found {
+		return cacheEntry{}, false
+	}
+	if headStateMethods[entry.method] {
+		touchHeadState(entry.key)
+	}
+	return resp.(cacheEntry), true
+}
+
+// Remembers the normalized form of a raw request.
+func storeRawRequest(req rawRequest, call rpcCall) {
+	rawcache.Set(req.key, rawEntry{key: string(call.requestJson), method: call.method}, rawCacheTime)
+}
+
+// Replaces the id of a json RPC response with the given raw json, without decoding the response.
+func spliceID(resp []byte, id []byte) ([]byte, bool) {
+	start := skipSpace(resp, 0)
+	end, ok := skipValue(resp, start)
+	if !ok || resp[start] != '{' {
+		return nil, false
+	}
+	idStart, idEnd, ok := objectField(resp[start:end], "id")
+	if !ok || idStart < 0 {
+		return nil, false
+	}
+	idStart += start
+	idEnd += start
+	if bytes.Equal(resp[idStart:idEnd], id) {
+		return resp, true
+	}
+	out := make([]byte, 0, len(resp)-(idEnd-idStart)+len(id))
+	out = append(out, resp[:idStart]...)
+	out = append(out, id...)
+	out = append(out, resp[idEnd:]...)
+	return out, true
+}
+
+// Finds the span of a top level field's value in a json object. The start is -1 if the field is not present.
+// Fails if any key is escaped, or the field is given more than once, as a decoder could then see a different field.
+func objectField(obj []byte, name string) (int, int, bool) {
+	start, end := -1, -1
+	i := skipSpace(obj, 1)
+	if i < len(obj) && obj[i] == '}' {
+		return start, end, true
+	}
+	for i < len(obj) {
+		if obj[i] != '"' {
+			return 0, 0, false
+		}
+		keyEnd, ok := skipValue(obj, i)
+		if !ok {
+			return 0, 0, false
+		}
+		key := obj[i+1 : keyEnd-1]
+		if bytes.IndexByte(key, '\\') >= 0 {
+			return 0, 0, false
+		}
+		i = skipSpace(obj, keyEnd)
+		if i >= len(obj) || obj[i] != ':' {
+			return 0, 0, false
+		}
+		valStart := skipSpace(obj, i+1)
+		valEnd, ok := skipValue(obj, valStart)
+		if !ok {
+			return 0, 0, false
+		}
+		if string(key) == name {
+			if start >= 0 {
+				return 0, 0, false
+			}
+			start, end = valStart, valEnd
+		}
+		i = skipSpace(obj, valEnd)
+		if i >= len(obj) {
+			return 0, 0, false
+		}
+		switch obj[i] {
+		case ',':
+			i = skipSpace(obj, i+1)
+		case '}':
+			return start, end, true
+		default:
+			return 0, 0, false
+		}
+	}
+	return 0, 0, false
+}
+
+func skipSpace(b []byte, i int) int {
+	for i < len(b) && isJSONSpace(b[i]) {
+		i++
+	}
+	return i
+}
+
+// Returns the end of the json value starting at i. Only finds the value's extent, it does not validate it.
+func skipValue(b []byte, i int) (int, bool) {
+	if i >= len(b) {
+		return 0, false
+	}
+	switch b[i] {
+	case '"':
+		for i++; i < len(b); i++ {
+			switch b[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, true
+			}
+		}
+		return 0, false
+	case '{', '[':
+		depth := 0
+		for ; i < len(b); i++ {
+			switch b[i] {
+			case '"':
+				end, ok := skipValue(b, i)
+				if !ok {
+					return 0, false
+				}
+				i = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, true
+				}
+			}
+		}
+		return 0, false
+	default:
+		start := i
+		for i < len(b) && b[i] != ',' && b[i] != '}' && b[i] != ']' && !isJSONSpace(b[i]) {
+			i++
+		}
+		return i, i > start
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import "testing"
+
+func TestSkipValue(t *testing.T) {
+	tests := []struct {
+		in  string
+		end int // -1 if the value is incomplete.
+	}{
+		{`"abc"`, 5},
+		{`"a\"b" `, 6},
+		{`"a\\"x`, 5},
+		{`{"a":[1,{"b":"}"}]}`, 19},
+		{`[1,2] x`, 5},
+		{`123,`, 3},
+		{`true}`, 4},
+		{`null ]`, 4},
+		{`"abc`, -1},
+		{`{"a":1`, -1},
+		{`[1,"]"`, -1},
+		{``, -1},
+		{`,`, -1},
+	}
+	for _, tt := range tests {
+		end, ok := skipValue([]byte(tt.in), 0)
+		if tt.end < 0 {
+			if ok {
+				t.Errorf("skipValue(%q) = %d, want incomplete", tt.in, end)
+			}
+			continue
+		}
+		if !ok || end != tt.end {
+			t.Errorf("skipValue(%q) = %d, %v, want %d", tt.in, end, ok, tt.end)
+		}
+	}
+}
+
+func TestObjectField(t *testing.T) {
+	tests := []struct {
+		in    string
+		value string // The field's value, or "" if it is not present.
+		ok    bool
+	}{
+		{`{"id":5}`, `5`, true},
+		{`{ "jsonrpc" : "2.0" , "id" : "x y" }`, `"x y"`, true},
+		{`{"a":{"id":1},"id":[1,2]}`, `[1,2]`, true},
+		{`{"method":"m","params":["id"]}`, ``, true},
+		{`{}`, ``, true},
+		{`{ }`, ``, true},
+		{`{"\u0069d":5}`, ``, false},
+		{`{"id":5,"m\"x":1}`, ``, false},
+		{`{"id":1,"id":2}`, ``, false},
+		{`{"id" 1}`, ``, false},
+		{`{"id":1 "a":2}`, ``, false},
+		{`{"id":1,`, ``, false},
+		{`{id:1}`, ``, false},
+	}
+	for _, tt := range tests {
+		obj := []byte(tt.in)
+		start, end, ok := objectField(obj, "id")
+		if ok != tt.ok {
+			t.Errorf("objectField(%q) ok = %v, want %v", tt.in, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		value := ""
+		if start >= 0 {
+			value = string(obj[start:end])
+		}
+		if value != tt.value {
+			t.Errorf("objectField(%q) = %q, want %q", tt.in, value, tt.value)
+		}
+	}
+}
+
+func TestSpliceID(t *testing.T) {
+	tests := []struct {
+		resp string
+		id   string
+		want string // "" if the id cannot be spliced.
+	}{
+		{`{"jsonrpc":"2.0","result":{"id":1},"id":"0"}`, `7`, `{"jsonrpc":"2.0","result":{"id":1},"id":7}`},
+		{`{"id":"0","result":[]}`, `{"a":"b"}`, `{"id":{"a":"b"},"result":[]}`},
+		{`{"id":"0","result":[]}`, `"0"`, `{"id":"0","result":[]}`},
+		{` {"result":1,"id":null}` + "\n", `"x"`, ` {"result":1,"id":"x"}` + "\n"},
+		{`{"result":1}`, `7`, ``},
+		{`{"id":"0","id":"1"}`, `7`, ``},
+		{`{"\u0069d":"0"}`, `7`, ``},
+		{`[{"id":"0"}]`, `7`, ``},
+		{`{"id":"0"`, `7`, ``},
+	}
+	for _, tt := range tests {
+		out, ok := spliceID([]byte(tt.resp), []byte(tt.id))
+		if tt.want == "" {
+			if ok {
+				t.Errorf("spliceID(%q, %s) = %q, want failure", tt.resp, tt.id, out)
+			}
+			continue
+		}
+		if !ok || string(out) != tt.want {
+			t.Errorf("spliceID(%q, %s) = %q, %v, want %q", tt.resp, tt.id, out, ok, tt.want)
+		}
+	}
+}
+
+func TestScanRawRequest(t *testing.T) {
+	a, ok := scanRawRequest([]byte(`{"jsonrpc":"2.0","method":"condenser_api.get_block","params":[1],"id":5}`))
+	if !ok || string(a.id) != `5` || a.arrayreq {
+		t.Fatalf("scanRawRequest = %+v, %v", a, ok)
+	}
+	b, ok := scanRawRequest([]byte(`{"jsonrpc":"2.0","method":"condenser_api.get_block","params":[1],"id":"x"}`))
+	if !ok || string(b.id) != `"x"` || b.key != a.key {
+		t.Errorf("requests differing only by id should share a key: %+v, %v", b, ok)
+	}
+	c, ok := scanRawRequest([]byte(`{"jsonrpc":"2.0","method":"condenser_api.get_block","params":[1]}`))
+	if !ok || string(c.id) != string(defaultRawID) || c.key == a.key {
+		t.Errorf("request without an id = %+v, %v", c, ok)
+	}
+	d, ok := scanRawRequest([]byte(` [ {"jsonrpc":"2.0","method":"condenser_api.get_block","params":[1],"id":5} ] `))
+	if !ok || !d.arrayreq || d.key == a.key {
+		t.Errorf("batch of one = %+v, %v", d, ok)
+	}
+
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"condenser_api.get_block","params":[1],"\u0069d":5}`,
+		`{"jsonrpc":"2.0","method":"condenser_api.get_block","params":[1],"id":5,"id":6}`,
+		`[{"id":1},{"id":2}]`,
+		`{"id":1} x`,
+		`{"id":1,}`,
+		`{"id":01x}`,
+		`[]`,
+		`"id"`,
+	} {
+		if req, ok := scanRawRequest([]byte(body)); ok {
+			t.Errorf("scanRawRequest(%q) = %+v, want it left to the decoder", body, req)
+		}
+	}
+}
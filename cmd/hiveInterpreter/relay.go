@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Largest response kept for the cache while relaying. Larger responses are passed through without being held in memory.
+const relayCacheMax = 1 << 20
+
+// Most of a response held for a client that is slower than its upstream. Past this the upstream is read at the client's pace.
+const relaySpoolMax = 16 << 20
+
+// Longest a write to the client may take while relaying, before the client is given up on.
+const relayWriteWait = 10 * time.Second
+
+// Relays an upstream response to the client as it arrives, with the client's id spliced in, instead of buffering it.
+// The upstream worker only reads the response into a spool, which is written out from here, so that a slow client
+// does not hold the worker or its upstream's concurrency limit.
+// Returns the upstream status and, if it was small enough to keep, the complete normalized response for the cache.
+// Nothing has been written to the client unless the status is OK.
+func relayResponse(ctx context.Context, w http.ResponseWriter, call rpcCall, id []byte, arrayreq bool) (int, []byte) {
+	sp := newRelaySpool()
+	var kept []byte
+	result := make(chan int, 1)
+	go func() {
+		status := requestToSink(ctx, ep2pool[call.target], call.requestJson, func(status int, body io.Reader) {
+			if status != http.StatusOK {
+				return
+			}
+			tee := &capBuffer{max: relayCacheMax}
+			if err := sp.fill(io.TeeReader(body, tee)); err != nil {
+				log.Println("Relaying response from", call.target, err)
+				return
+			}
+			if !tee.over {
+				kept = tee.buf
+			}
+		})
+		sp.close()
+		result <- status
+	}()
+
+	cw := &relayWriter{w: w, arrayreq: arrayreq}
+	var dst io.Writer = cw
+	if !bytes.Equal(id, defaultRawID) {
+		dst = &idRewriter{w: cw, id: id}
+	}
+	rc := http.NewResponseController(w)
+	for {
+		chunk, ok := sp.next()
+		if !ok {
+			break
+		}
+		rc.SetWriteDeadline(time.Now().Add(relayWriteWait))
+		if _, err := dst.Write(chunk); err != nil {
+			// The client is gone or stalled: let the worker finish without it.
+			sp.abandon()
+			break
+		}
+	}
+	status := <-result
+	if cw.started && arrayreq {
+		w.Write([]byte{']'})
+	}
+	rc.SetWriteDeadline(time.Time{})
+	if status == http.StatusOK && !cw.started {
+		log.Println("Bad (empty) response from upstream: " + call.target)
+		return http.StatusInternalServerError, nil
+	}
+	return status, kept
+}
+
+// Chunks of an upstream response read by a worker, for the handler to write to the client at the client's pace.
+type relaySpool struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	chunks    [][]byte
+	size      int
+	closed    bool
+	abandoned bool
+}
+
+func newRelaySpool() *relaySpool {
+	sp := &relaySpool{}
+	sp.cond = sync.NewCond(&sp.mu)
+	return sp
+}
+
+// Reads r into the spool, waiting while the spool is full. Once abandoned, r is still read through but not kept.
+func (sp *relaySpool) fill(r io.Reader) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			sp.push(append([]byte(nil), buf[:n]...))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (sp *relaySpool) push(p []byte) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for sp.size >= relaySpoolMax && !sp.abandoned {
+		sp.cond.Wait()
+	}
+	if sp.abandoned {
+		return
+	}
+	sp.chunks = append(sp.chunks, p)
+	sp.size += len(p)
+	sp.cond.Broadcast()
+}
+
+// Takes the next chunk, waiting for one. Returns false once the spool is closed and empty.
+func (sp *relaySpool) next() ([]byte, bool) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for len(sp.chunks) == 0 && !sp.closed {
+		sp.cond.Wait()
+	}
+	if len(sp.chunks) == 0 {
+		return nil, false
+	}
+	p := sp.chunks[0]
+	sp.chunks[0] = nil
+	sp.chunks = sp.chunks[1:]
+	sp.size -= len(p)
+	sp.cond.Broadcast()
+	return p, true
+}
+
+// Marks the response as complete.
+func (sp *relaySpool) close() {
+	sp.mu.Lock()
+	sp.closed = true
+	sp.cond.Broadcast()
+	sp.mu.Unlock()
+}
+
+// Drops what is held, and anything more, as no one will take it.
+func (sp *relaySpool) abandon() {
+	sp.mu.Lock()
+	sp.abandoned = true
+	sp.chunks = nil
+	sp.size = 0
+	sp.cond.Broadcast()
+	sp.mu.Unlock()
+}
+
+// Writes the response headers, and the batch opening if needed, with the first bytes of the body.
+type relayWriter struct {
+	w        http.ResponseWriter
+	arrayreq bool
+	started  bool
+}
+
+func (rw *relayWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !rw.started {
+		rw.started = true
+		rw.w.Header().Set("Content-Type", "application/json")
+		if rw.arrayreq {
+			if _, err := rw.w.Write([]byte{'['}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return rw.w.Write(p)
+}
+
+// Keeps what is written to it, until it grows past max.
+type capBuffer struct {
+	buf  []byte
+	max  int
+	over bool
+}
+
+func (cb *capBuffer) Write(p []byte) (int, error) {
+	if !cb.over {
+		if len(cb.buf)+len(p) > cb.max {
+			cb.over = true
+			cb.buf = nil
+		} else {
+			cb.buf = append(cb.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// States of an idRewriter.
+const (
+	idSeek     = iota // Looking for the top level "id" key.
+	idColon           // Found the key, waiting for its colon.
+	idValue           // Waiting for the value to start.
+	idSkipStr         // Dropping a string value.
+	idSkipNest        // Dropping an object or array value.
+	idSkipWord        // Dropping a number, bool or null value.
+	idDone            // Replaced, passing the rest through.
+)
+
+// Rewrites the value of the top level "id" of a json object as it is streamed through, so that a response
+// can be given back the client's id without being buffered.
+type idRewriter struct {
+	w   io.Writer
+	id  []byte
+	out []byte
+
+	state     int
+	depth     int
+	inStr     bool
+	esc       bool
+	isKey     bool
+	expectKey bool
+	key       []byte
+}
+
+func (ir *idRewriter) Write(p []byte) (int, error) {
+	if ir.state == idDone {
+		return ir.w.Write(p)
+	}
+	ir.out = ir.out[:0]
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch ir.state {
+		case idDone:
+			ir.out = append(ir.out, p[i:]...)
+			i = len(p)
+		case idSkipStr:
+			switch {
+			case ir.esc:
+				ir.esc = false
+			case c == '\\':
+				ir.esc = true
+			case c == '"':
+				ir.state = idDone
+			}
+		case idSkipNest:
+			switch {
+			case ir.inStr:
+				if ir.esc {
+					ir.esc = false
+				} else if c == '\\' {
+					ir.esc = true
+				} else if c == '"' {
+					ir.inStr = false
+				}
+			case c == '"':
+				ir.inStr = true
+			case c == '{' || c == '[':
+				ir.depth++
+			case c == '}' || c == ']':
+				ir.depth--
+				if ir.depth == 0 {
+					ir.state = idDone
+				}
+			}
+		case idSkipWord:
+			if c == ',' || c == '}' || c == ']' || isJSONSpace(c) {
+				ir.state = idDone
+				ir.out = append(ir.out, c)
+			}
+		case idValue:
+			if isJSONSpace(c) {
+				ir.out = append(ir.out, c)
+				continue
+			}
+			ir.out = append(ir.out, ir.id...)
+			switch c {
+			case '"':
+				ir.state = idSkipStr
+			case '{', '[':
+				ir.state = idSkipNest
+				ir.depth = 1
+			default:
+				ir.state = idSkipWord
+			}
+		case idColon:
+			ir.out = append(ir.out, c)
+			if c == ':' {
+				ir.state = idValue
+			}
+		case idSeek:
+			ir.out = append(ir.out, c)
+			if ir.inStr {
+				switch {
+				case ir.esc:
+					ir.esc = false
+				case c == '\\':
+					ir.esc = true
+				case c == '"':
+					ir.inStr = false
+					if ir.isKey && string(ir.key) == "id" {
+						ir.state = idColon
+					}
+					continue
+				}
+				if ir.isKey {
+					ir.key = append(ir.key, c)
+				}
+				continue
+			}
+			switch c {
+			case '"':
+				ir.inStr = true
+				ir.isKey = ir.depth == 1 && ir.expectKey
+				ir.expectKey = false
+				ir.key = ir.key[:0]
+			case '{', '[':
+				ir.depth++
+				ir.expectKey = c == '{' && ir.depth == 1
+			case '}', ']':
+				ir.depth--
+			case ',':
+				ir.expectKey = ir.depth == 1
+			}
+		}
+	}
+	if _, err := ir.w.Write(ir.out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
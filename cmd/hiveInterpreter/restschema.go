@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of REST parameters.
+const (
+	paramString  = "string"
+	paramInteger = "integer"
+	paramBoolean = "boolean"
+	// A json value, such as a compound start key. Values that are not json are taken as strings.
+	paramJSON = "json"
+)
+
+// A parameter of a REST method, given as a query value.
+type restParam struct {
+	name     string
+	kind     string // paramString, paramInteger, paramBoolean or paramJSON; the element type for arrays.
+	array    bool   // Given as repeated or comma separated values.
+	required bool
+	enum     []string
+	min, max int64       // Bounds of an integer parameter, if max is not zero.
+	def      interface{} // Sent when the parameter is not given.
+	desc     string
+}
+
+// Parameters of a REST method. Methods without a schema have their query flattened as is.
+type restMethod struct {
+	params  []restParam
+	example string // A response, for the API document.
+}
+
+// Parameter schemas, by api and method as sent upstream.
+var restSchemas = map[string]restMethod{
+	"block_api.get_block": {params: []restParam{
+		{name: "block_num", kind: paramInteger, required: true},
+	}, example: `{"block": {"previous": "0393886fe4a2b6a04cf5ee39e2bc55ccfbc9bbea", "timestamp": "2021-12-13T11:30:36", "witness": "blocktrades", "transaction_merkle_root": "0000000000000000000000000000000000000000", "extensions": [], "witness_signature": "1f5e...", "transactions": [], "block_id": "039388700c4d8c9abfa5d1c8a5f07b47b7ae1cf7", "signing_key": "STM5...", "transaction_ids": []}}`},
+	"block_api.get_block_header": {params: []restParam{
+		{name: "block_num", kind: paramInteger, required: true},
+	}},
+	"block_api.get_block_range": {params: []restParam{
+		{name: "starting_block_num", kind: paramInteger, required: true},
+		{name: "count", kind: paramInteger, required: true, min: 1, max: 1, desc: "Only 1 is allowed."},
+	}},
+
+	"database_api.get_dynamic_global_properties": {example: `{"head_block_number": 60000000, "head_block_id": "039387009c5f0f4d8e3bbce59e4e3d5f6d0b1c4a", "time": "2021-12-13T11:30:36", "current_witness": "blocktrades", "current_supply": {"amount": "391849215316", "precision": 3, "nai": "@@000000021"}, "virtual_supply": {"amount": "415271519843", "precision": 3, "nai": "@@000000021"}, "last_irreversible_block_num": 59999980}`},
+	"database_api.get_config":                    {},
+	"database_api.get_version":                   {},
+	"database_api.get_hardfork_properties":       {},
+	"database_api.get_witness_schedule":          {},
+	"database_api.get_current_price_feed":        {},
+	"database_api.get_feed_history":              {},
+	"database_api.get_reward_funds":              {},
+	"database_api.find_accounts": {params: []restParam{
+		{name: "accounts", kind: paramString, array: true, required: true},
+		{name: "delayed_votes_active", kind: paramBoolean},
+	}, example: `{"accounts": [{"id": 28, "name": "alice", "balance": {"amount": "1000", "precision": 3, "nai": "@@000000021"}, "post_count": 12}]}`},
+	"database_api.list_accounts": {params: []restParam{
+		{name: "start", kind: paramJSON, desc: "A name, or a [proxy, name] or [time, name] pair by the order. From the beginning if not given."},
+		{name: "limit", kind: paramInteger, required: true},
+		{name: "order", kind: paramString, required: true, enum: []string{"by_name", "by_proxy", "by_next_vesting_withdrawal"}},
+		{name: "delayed_votes_active", kind: paramBoolean},
+	}},
+	"database_api.list_witnesses": {params: []restParam{
+		{name: "start", kind: paramJSON, desc: "A name, or a [votes, name] or [time, name] pair by the order. Needed except by name."},
+		{name: "limit", kind: paramInteger, required: true},
+		{name: "order", kind: paramString, required: true, enum: []string{"by_name", "by_vote_name", "by_schedule_time"}},
+	}},
+	"database_api.list_proposals": {params: []restParam{
+		{name: "start", kind: paramJSON, required: true, desc: "The key to start from by the order, as a list, e.g. [\"alice\"] by creator."},
+		{name: "limit", kind: paramInteger, required: true},
+		{name: "order", kind: paramString, required: true, enum: []string{"by_creator", "by_start_date", "by_end_date", "by_total_votes"}},
+		{name: "order_direction", kind: paramString, def: "ascending", enum: []string{"ascending", "descending"}},
+		{name: "status", kind: paramString, def: "all", enum: []string{"all", "inactive", "active", "expired", "votable"}},
+		{name: "last_id", kind: paramInteger},
+	}},
+	"database_api.find_witnesses": {params: []restParam{
+		{name: "owners", kind: paramString, array: true, required: true},
+	}},
+	"database_api.find_vesting_delegations": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+	}},
+	"database_api.get_transaction_hex": {params: []restParam{
+		{name: "trx", kind: paramJSON, required: true, desc: "The transaction, as a json object. Easiest posted in the body."},
+	}},
+	"database_api.get_required_signatures": {params: []restParam{
+		{name: "trx", kind: paramJSON, required: true, desc: "The transaction, as a json object. Easiest posted in the body."},
+		{name: "available_keys", kind: paramString, array: true, required: true},
+	}},
+	"database_api.get_potential_signatures": {params: []restParam{
+		{name: "trx", kind: paramJSON, required: true, desc: "The transaction, as a json object. Easiest posted in the body."},
+	}},
+	"database_api.verify_authority": {params: []restParam{
+		{name: "trx", kind: paramJSON, required: true, desc: "The signed transaction, as a json object. Easiest posted in the body."},
+		{name: "pack", kind: paramString, enum: []string{"hf26", "legacy"}},
+	}, example: `{"valid": true}`},
+	"database_api.verify_account_authority": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "signers", kind: paramString, array: true, required: true},
+	}, example: `{"valid": true}`},
+
+	"account_history_api.get_account_history": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "start", kind: paramInteger, def: json.Number("-1"), desc: "Sequence number to page back from, -1 for the latest."},
+		{name: "limit", kind: paramInteger, def: json.Number("1000")},
+		{name: "include_reversible", kind: paramBoolean},
+		{name: "operation_filter_low", kind: paramInteger},
+		{name: "operation_filter_high", kind: paramInteger},
+	}, example: `{"history": [[12, {"trx_id": "3f0e4d3c4e1c3cbe8e3f3a4e7a1c0d2b5e6f7a8b", "block": 59999990, "trx_in_block": 3, "op_in_trx": 0, "virtual_op": false, "timestamp": "2021-12-13T11:30:06", "op": {"type": "vote_operation", "value": {"voter": "alice", "author": "bob", "permlink": "hello", "weight": 10000}}}]]}`},
+	"account_history_api.enum_virtual_ops": {params: []restParam{
+		{name: "block_range_begin", kind: paramInteger, required: true},
+		{name: "block_range_end", kind: paramInteger, required: true},
+		{name: "include_reversible", kind: paramBoolean},
+		{name: "group_by_block", kind: paramBoolean},
+		{name: "operation_begin", kind: paramInteger},
+		{name: "limit", kind: paramInteger},
+		{name: "filter", kind: paramInteger},
+	}},
+	"account_history_api.get_ops_in_block": {params: []restParam{
+		{name: "block_num", kind: paramInteger, required: true},
+		{name: "only_virtual", kind: paramBoolean},
+		{name: "include_reversible", kind: paramBoolean},
+	}},
+	"account_history_api.get_transaction": {params: []restParam{
+		{name: "id", kind: paramString, required: true},
+		{name: "include_reversible", kind: paramBoolean},
+	}},
+
+	"rc_api.find_rc_accounts": {params: []restParam{
+		{name: "accounts", kind: paramString, array: true, required: true},
+	}},
+	"rc_api.list_rc_accounts": {params: []restParam{
+		{name: "start", kind: paramJSON, required: true, desc: "An account name."},
+		{name: "limit", kind: paramInteger, required: true},
+	}},
+	"rc_api.list_rc_direct_delegations": {params: []restParam{
+		{name: "start", kind: paramJSON, required: true, desc: "A [from, to] pair of account names."},
+		{name: "limit", kind: paramInteger, required: true},
+	}},
+	"rc_api.get_resource_params": {},
+	"rc_api.get_resource_pool":   {},
+
+	"reputation_api.get_account_reputations": {params: []restParam{
+		{name: "account_lower_bound", kind: paramString},
+		{name: "limit", kind: paramInteger},
+	}},
+
+	"market_history_api.get_ticker":     {},
+	"market_history_api.get_volume":     {},
+	"market_history_api.get_order_book": {params: []restParam{{name: "limit", kind: paramInteger}}},
+	"market_history_api.get_recent_trades": {params: []restParam{
+		{name: "limit", kind: paramInteger},
+	}},
+	"market_history_api.get_trade_history": {params: []restParam{
+		{name: "start", kind: paramString, required: true},
+		{name: "end", kind: paramString, required: true},
+		{name: "limit", kind: paramInteger},
+	}},
+
+	"bridge.get_ranked_posts": {params: []restParam{
+		{name: "sort", kind: paramString, required: true, enum: []string{"trending", "hot", "created", "promoted", "payout", "payout_comments", "muted"}},
+		{name: "tag", kind: paramString},
+		{name: "observer", kind: paramString},
+		{name: "limit", kind: paramInteger},
+		{name: "start_author", kind: paramString},
+		{name: "start_permlink", kind: paramString},
+	}},
+	"bridge.get_account_posts": {params: []restParam{
+		{name: "sort", kind: paramString, required: true, enum: []string{"blog", "feed", "posts", "comments", "replies", "payout"}},
+		{name: "account", kind: paramString, required: true},
+		{name: "observer", kind: paramString},
+		{name: "limit", kind: paramInteger},
+		{name: "start_author", kind: paramString},
+		{name: "start_permlink", kind: paramString},
+	}},
+	"bridge.get_post": {params: []restParam{
+		{name: "author", kind: paramString, required: true},
+		{name: "permlink", kind: paramString, required: true},
+		{name: "observer", kind: paramString},
+	}, example: `{"post_id": 1, "author": "bob", "permlink": "hello", "category": "hive", "title": "Hello", "body": "Hello, Hive.", "created": "2021-12-13T11:30:36", "children": 0, "payout": 1.234, "stats": {"total_votes": 3}}`},
+	"bridge.get_profile": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "observer", kind: paramString},
+	}},
+	"bridge.get_community": {params: []restParam{
+		{name: "name", kind: paramString, required: true},
+		{name: "observer", kind: paramString},
+	}},
+	"bridge.list_communities": {params: []restParam{
+		{name: "last", kind: paramString},
+		{name: "limit", kind: paramInteger},
+		{name: "query", kind: paramString},
+		{name: "sort", kind: paramString, enum: []string{"rank", "new", "subs"}},
+		{name: "observer", kind: paramString},
+	}},
+	"bridge.get_trending_topics": {params: []restParam{
+		{name: "limit", kind: paramInteger},
+		{name: "observer", kind: paramString},
+	}},
+	"bridge.account_notifications": {params: []restParam{
+		{name: "account", kind: paramString, required: true},
+		{name: "min_score", kind: paramInteger},
+		{name: "last_id", kind: paramInteger},
+		{name: "limit", kind: paramInteger},
+	}},
+}
+
+// A method provided by the interpreter itself rather than an upstream, under any api.
+type restExtension struct {
+	params  []restParam
+	desc    string
+	api     string // The api it is documented under.
+	example string
+	text    bool // Responds with plain text rather than json.
+	handler func(ctx context.Context, targetUrl string, params map[string]interface{}, w http.ResponseWriter, mark time.Time) error
+}
+
+var restExtensions = map[string]restExtension{
+	"get_block_by_time": {
+		params:  []restParam{{name: "timestamp", kind: paramString, required: true, desc: "Chain time, e.g. 2021-12-13T11:30:36."}},
+		desc:    "The block produced at the given time.",
+		api:     "block_api",
+		example: `{"id": "0", "jsonrpc": "2.0", "result": {"block": {"block": 60000000, "previous": "0393886fe4a2b6a04cf5ee39e2bc55ccfbc9bbea", "timestamp": "2021-12-13T11:30:36", "witness": "blocktrades", "transactions": [], "block_id": "039388700c4d8c9abfa5d1c8a5f07b47b7ae1cf7", "transaction_ids": []}}}`,
+		handler: getBlockByTime,
+	},
+	"get_total_supply": {
+		desc:    "The virtual supply of HIVE, as a plain decimal.",
+		api:     "database_api",
+		example: "415271519.843",
+		text:    true,
+		handler: func(ctx context.Context, targetUrl string, _ map[string]interface{}, w http.ResponseWriter, _ time.Time) error {
+			return getTotalSupply(ctx, targetUrl, "virtual_supply", w)
+		},
+	},
+	"get_circulating_supply": {
+		desc:    "The current supply of HIVE, as a plain decimal.",
+		api:     "database_api",
+		example: "391849215.316",
+		text:    true,
+		handler: func(ctx context.Context, targetUrl string, _ map[string]interface{}, w http.ResponseWriter, _ time.Time) error {
+			return getTotalSupply(ctx, targetUrl, "current_supply", w)
+		},
+	},
+	"get_original_body": {
+		params: []restParam{
+			{name: "author", kind: paramString, required: true},
+			{name: "permlink", kind: paramString, required: true},
+		},
+		desc:    "The body a post was first published with, and the diff to its latest version.",
+		api:     "condenser_api",
+		example: `{"body": "Hello, Hive.", "edited": true, "diff_to_latest": "=12\t+ Edited."}`,
+		handler: getOriginalBody,
+	},
+}
+
+// The params of a REST call of an upstream method, typed by its schema or, for condenser_api, its signature, along
+// with the typed params by name. Methods without either are flattened, and have no named params.
+// Values may be given in the query, or as json in the body of a POST. Adjust, if given, may change the named params
+// before they are made positional.
+func restParams(method string, q url.Values, body map[string]json.RawMessage, adjust func(named map[string]interface{}) error) (interface{}, map[string]interface{}, error) {
+	var schema []restParam
+	var sig *condenserSignature
+	if s, ok := condenserSignatures[strings.TrimPrefix(method, "condenser_api.")]; ok && strings.HasPrefix(method, "condenser_api.") {
+		schema, sig = s.params, &s
+	} else if m, ok := restSchemas[method]; ok {
+		schema = m.params
+	} else {
+		params := Flatten(q)
+		for name, raw := range body {
+			if _, ok := params[name]; ok {
+				return nil, nil, bothParamError(name, method)
+			}
+			params[name] = raw
+		}
+		return params, nil, nil
+	}
+	named, err := buildRESTParams(schema, q, body, method)
+	if err == nil && adjust != nil {
+		err = adjust(named)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if sig != nil {
+		params, err := condenserParams(*sig, named, method)
+		return params, named, err
+	}
+	return named, named, nil
+}
+
+// Builds typed params from query values and body members by a schema. Bad, missing and unknown parameters are
+// returned as a *statusError naming the parameter.
+func buildRESTParams(schema []restParam, q url.Values, body map[string]json.RawMessage, method string) (map[string]interface{}, error) {
+	known := make(map[string]bool, len(schema))
+	for _, p := range schema {
+		known[p.name] = true
+	}
+	for name := range q {
+		if !known[name] {
+			return nil, unknownParamError(schema, name, method)
+		}
+	}
+	for name := range body {
+		if !known[name] {
+			return nil, unknownParamError(schema, name, method)
+		}
+		if _, ok := q[name]; ok {
+			return nil, bothParamError(name, method)
+		}
+	}
+
+	params := make(map[string]interface{}, len(schema))
+	for _, p := range schema {
+		if raw, ok := body[p.name]; ok && string(raw) != "null" {
+			v, err := p.parseJSON(raw)
+			if err != nil {
+				return nil, newStatusError(http.StatusBadRequest, "Bad parameter "+strconv.Quote(p.name)+" for "+method+": "+err.Error())
+			}
+			params[p.name] = v
+			continue
+		}
+		values, ok := q[p.name]
+		if !ok {
+			if p.required {
+				return nil, newStatusError(http.StatusBadRequest, "Missing parameter "+strconv.Quote(p.name)+" for "+method)
+			}
+			if p.def != nil {
+				params[p.name] = p.def
+			}
+			continue
+		}
+		v, err := p.parse(values)
+		if err != nil {
+			return nil, newStatusError(http.StatusBadRequest, "Bad parameter "+strconv.Quote(p.name)+" for "+method+": "+err.Error())
+		}
+		params[p.name] = v
+	}
+	return params, nil
+}
+
+func unknownParamError(schema []restParam, name string, method string) error {
+	names := make([]string, 0, len(schema))
+	for _, p := range schema {
+		names = append(names, p.name)
+	}
+	sort.Strings(names)
+	msg := "Unknown parameter " + strconv.Quote(name) + " for " + method
+	if len(names) == 0 {
+		msg += ", which takes none"
+	} else {
+		msg += ", expected one of: " + strings.Join(names, ", ")
+	}
+	return newStatusError(http.StatusBadRequest, msg)
+}
+
+func bothParamError(name string, method string) error {
+	return newStatusError(http.StatusBadRequest, "Parameter "+strconv.Quote(name)+" for "+method+" is given in both the query and the body")
+}
+
+// Parses a parameter's query values. Arrays may be given as a json array.
+func (p restParam) parse(values []string) (interface{}, error) {
+	if !p.array {
+		if len(values) != 1 {
+			return nil, errors.New("expected a single value")
+		}
+		return p.parseOne(values[0])
+	}
+	if len(values) == 1 && strings.HasPrefix(values[0], "[") && json.Valid([]byte(values[0])) {
+		return p.parseJSON(json.RawMessage(values[0]))
+	}
+	out := []interface{}{}
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item == "" {
+				continue
+			}
+			x, err := p.parseOne(item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, x)
+		}
+	}
+	return out, nil
+}
+
+func (p restParam) parseOne(v string) (interface{}, error) {
+	if p.enum != nil {
+		found := false
+		for _, e := range p.enum {
+			found = found || e == v
+		}
+		if !found {
+			return nil, errors.New("must be one of " + strings.Join(p.enum, ", "))
+		}
+	}
+	switch p.kind {
+	case paramInteger:
+		// Kept as a json number, so that unsigned 64 bit values such as operation filters survive. It is written out
+		// again, as the query may have a sign or leading zeros that json does not allow.
+		n, err := strconv.ParseInt(v, 10, 64)
+		text := strconv.FormatInt(n, 10)
+		if err != nil {
+			u, uerr := strconv.ParseUint(v, 10, 64)
+			if uerr != nil {
+				return nil, errors.New("must be an integer")
+			}
+			text = strconv.FormatUint(u, 10)
+		}
+		if p.max != 0 && (err != nil || n < p.min || n > p.max) {
+			if p.min == p.max {
+				return nil, errors.New("must be " + strconv.FormatInt(p.max, 10))
+			}
+			return nil, errors.New("must be from " + strconv.FormatInt(p.min, 10) + " to " + strconv.FormatInt(p.max, 10))
+		}
+		return json.Number(text), nil
+	case paramBoolean:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		return b, nil
+	case paramJSON:
+		if c, err := canonicalJSON([]byte(v)); err == nil {
+			return c, nil
+		}
+	}
+	return v, nil
+}
+
+// Parses a parameter's value given as json. Values other than json params are checked as their query text would be,
+// so that they are sent just as they would be from a query. An array may be given as a single item.
+func (p restParam) parseJSON(raw json.RawMessage) (interface{}, error) {
+	if !p.array {
+		return p.parseJSONOne(raw)
+	}
+	var items []json.RawMessage
+	if jsonit.Unmarshal(raw, &items) != nil {
+		items = []json.RawMessage{raw}
+	}
+	out := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		x, err := p.parseJSONOne(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, x)
+	}
+	return out, nil
+}
+
+func (p restParam) parseJSONOne(raw json.RawMessage) (interface{}, error) {
+	if p.kind == paramJSON {
+		return canonicalJSON(raw)
+	}
+	var v interface{}
+	if err := jsonit.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	switch x := v.(type) {
+	case string:
+		return p.parseOne(x)
+	case json.Number:
+		return p.parseOne(x.String())
+	case bool:
+		return p.parseOne(strconv.FormatBool(x))
+	}
+	return nil, errors.New("must be a " + p.kind)
+}
+
+// Json with its object keys sorted and without spaces, so that equal values make equal requests, and cache keys.
+func canonicalJSON(raw []byte) (json.RawMessage, error) {
+	var v interface{}
+	if err := jsonit.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return jsonit.Marshal(v)
+}
+
+// Largest body a REST call may have.
+const maxRESTBody = 1 << 20
+
+// Reads the params in the body of a REST call: a json object, or nothing. The values are made canonical.
+func readRESTBody(r *http.Request) (map[string]json.RawMessage, error) {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return nil, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxRESTBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, newStatusError(http.StatusBadRequest, "Couldn't read body")
+	}
+	if len(b) > maxRESTBody {
+		return nil, newStatusError(http.StatusRequestEntityTooLarge, "Body is too large")
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+	var body map[string]json.RawMessage
+	if err := jsonit.Unmarshal(b, &body); err != nil || body == nil {
+		return nil, newStatusError(http.StatusBadRequest, "Body must be a json object of parameters")
+	}
+	for name, raw := range body {
+		if body[name], err = canonicalJSON(raw); err != nil {
+			return nil, newStatusError(http.StatusBadRequest, "Body must be a json object of parameters")
+		}
+	}
+	return body, nil
+}
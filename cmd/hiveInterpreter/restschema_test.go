@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseInteger(t *testing.T) {
+	plain := restParam{name: "n", kind: paramInteger}
+	bounded := restParam{name: "n", kind: paramInteger, min: 1, max: 100}
+	tests := []struct {
+		p    restParam
+		in   string
+		want string // "" if the value is refused.
+	}{
+		{plain, "7", "7"},
+		{plain, "+5", "5"},
+		{plain, "007", "7"},
+		{plain, "-007", "-7"},
+		{plain, "-0", "0"},
+		{plain, "18446744073709551615", "18446744073709551615"},
+		{plain, "18446744073709551616", ""},
+		{plain, "1.5", ""},
+		{plain, "", ""},
+		{plain, "x", ""},
+		{bounded, "+5", "5"},
+		{bounded, "0100", "100"},
+		{bounded, "0", ""},
+		{bounded, "101", ""},
+		{bounded, "18446744073709551615", ""},
+	}
+	for _, tt := range tests {
+		v, err := tt.p.parseOne(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseOne(%q) = %v, want an error", tt.in, v)
+			}
+			continue
+		}
+		if err != nil || v != json.Number(tt.want) {
+			t.Errorf("parseOne(%q) = %v, %v, want %s", tt.in, v, err, tt.want)
+		}
+	}
+
+	// Equal values given as json strings make equal requests.
+	for _, raw := range []string{`"+5"`, `"005"`, `5`} {
+		v, err := plain.parseJSON(json.RawMessage(raw))
+		if err != nil || v != json.Number("5") {
+			t.Errorf("parseJSON(%s) = %v, %v, want 5", raw, v, err)
+		}
+	}
+}
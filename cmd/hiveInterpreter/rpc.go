@@ -1,17 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"log"
 	"net/http"
 	"path"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
-	jsoniter "github.com/json-iterator/go"
+	"github.com/gorilla/websocket"
+	"github.com/patrickmn/go-cache"
 )
 
 // Condenser APIs considered to be 'light' and not requiring a full node.
@@ -128,6 +130,16 @@ var cacheTime = map[string]int{
 	"unread_notifications": 60,
 }
 
+// Methods about a single block. Their responses cannot change once the block is irreversible.
+var blockMethods = map[string]bool{
+	"get_block":        true,
+	"get_block_header": true,
+	"get_ops_in_block": true,
+}
+
+// Cache time for responses about irreversible blocks.
+const irreversibleCacheTime = 60
+
 // Handle a REST request. This is interpreted to the appropriate json RPC call.
 func doHandleREST(w http.ResponseWriter, r *http.Request) {
 	mark := time.Now()
@@ -149,8 +161,6 @@ func doHandleREST(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fparams := Flatten(r.URL.Query())
-
 	if api_call == "hive" || api_call == "bridge" {
 		target_url = hiveep
 	}
@@ -161,29 +171,95 @@ func doHandleREST(w http.ResponseWriter, r *http.Request) {
 	if abliteAPIs[api_call] {
 		target_url = liteep
 	}
-	reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": api_call + "." + api_method, "params": fparams}
+	method := api_call + "." + api_method
+	ctx := jobContext(r.Context(), clientIdentity(r), api_method)
 
-	if api_method == "get_block_by_time" {
-		params := r.URL.Query()
-		getBlockByTime(target_url, params, w, mark)
+	// Params may also be posted as a json object, for those with values too large or nested for a query.
+	body, err := readRESTBody(r)
+	if err != nil {
+		writeExtensionError(w, err)
 		return
 	}
 
-	if api_method == "get_total_supply" {
-		getTotalSupply(target_url, "virtual_supply", w)
+	if ext, ok := restExtensions[api_method]; ok {
+		params, err := buildRESTParams(ext.params, r.URL.Query(), body, method)
+		if err == nil {
+			err = ext.handler(ctx, target_url, params, w, mark)
+		}
+		if err != nil {
+			writeExtensionError(w, err)
+		}
 		return
 	}
 
-	if api_method == "get_circulating_supply" {
-		getTotalSupply(target_url, "current_supply", w)
+	q := r.URL.Query()
+	var fields projection
+	if list, ok := q[fieldsParam]; ok {
+		delete(q, fieldsParam)
+		var err error
+		if fields, err = parseFields(list); err != nil {
+			http.Error(w, "Bad fields: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// List results can be sent as csv or ndjson rather than json, asked for by parameter or Accept.
+	format, explicit, err := restFormat(r, q)
+	if err != nil {
+		http.Error(w, "Bad parameter \"format\" for "+method+": "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	delete(q, formatParam)
+	table, tabular := restTables[method]
+	if tabular && !explicit {
+		w.Header().Add("Vary", "Accept")
+	}
+	if !tabular && format != formatJSON {
+		if explicit {
+			http.Error(w, "Bad parameter \"format\" for "+method+": its result is not a list", http.StatusBadRequest)
+			return
+		}
+		format = formatJSON
+	}
+	var columns []tableColumn
+	if list, ok := q[columnsParam]; ok {
+		delete(q, columnsParam)
+		if format == formatJSON {
+			http.Error(w, "Parameter \"columns\" for "+method+" is only for csv and ndjson output", http.StatusBadRequest)
+			return
+		}
+		if columns, err = parseColumns(list); err != nil {
+			http.Error(w, "Bad parameter \"columns\" for "+method+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	if api_method == "get_original_body" {
-		fparams := Flatten(r.URL.Query())
-		getOriginalBody(target_url, fparams, w, mark)
+	// Listings are paged with cursors, given with the query they were made for.
+	pager, paged := restPagers[method]
+	var cursor *restCursor
+	var adjust func(map[string]interface{}) error
+	scope := method
+	if len(body) > 0 {
+		b, _ := jsonit.Marshal(body)
+		scope += string(b)
+	}
+	hash := cursorHash(scope, q)
+	if paged {
+		if c := q.Get(cursorParam); c != "" {
+			var err error
+			if cursor, err = decodeCursor(c, hash); err != nil {
+				writeExtensionError(w, err)
+				return
+			}
+		}
+		delete(q, cursorParam)
+		adjust = func(named map[string]interface{}) error { return pager.prepare(named, cursor, method) }
+	}
+	params, named, err := restParams(method, q, body, adjust)
+	if err != nil {
+		writeExtensionError(w, err)
 		return
 	}
+	reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": method, "params": params}
 
 	requestJson, err := jsonit.Marshal(reqmessage)
 	if err != nil {
@@ -193,43 +269,86 @@ func doHandleREST(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Pages, projections and tables are made from the full json RPC response. Projections of single pages are cached
+	// apart from it; the rest are made as they are served.
+	if fields != nil || paged || format != formatJSON {
+		call := rpcCall{requestJson: requestJson, target: target_url, method: api_method}
+		if blockMethods[api_method] {
+			call.blockNum = requestBlockNum(params)
+		}
+		if !paged {
+			call.fields = fields
+		}
+		status, respJson, gcached := fetchResponse(ctx, call)
+		if status == http.StatusOK && paged {
+			var next *restCursor
+			if respJson, next, err = pager.page(respJson, named, cursor, hash); err == nil && fields != nil {
+				respJson, err = projectResponse(respJson, fields)
+			}
+			if err != nil {
+				status = http.StatusBadGateway
+			} else if next != nil {
+				w.Header().Set("Link", "<"+nextPageLink(r, next)+">; rel=\"next\"")
+				w.Header().Set("X-Next-Cursor", next.encode())
+			}
+		}
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if format != formatJSON && writeTable(w, table, respJson, format, columns) {
+			logCall(call, mark, gcached)
+			return
+		}
+		if respJson, ok := formatRESTResponse(respJson); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(respJson)
+		} else {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+		logCall(call, mark, gcached)
+		return
+	}
+
 	// Have both request and target here.
-	var resp map[string]interface{}
-	var respreal map[string]interface{}
 	var respJson []byte
-	key := string(requestJson)
+	// REST entries hold reformatted responses, so must not share keys with json RPC entries.
+	key := "rest:" + string(requestJson)
 	var status int
 	var gcached bool
 	if x, found := respcache.Get(key); found {
-		respJson = x.([]byte)
 		gcached = true
+		if headStateMethods[api_method] {
+			touchHeadState(key)
+		}
+		ce := x.(cacheEntry)
+		if writeEncoded(w, r, ce) {
+			logCall(rpcCall{requestJson: requestJson, target: target_url}, mark, gcached)
+			return
+		}
+		if respJson, err = ce.bytes(); err != nil {
+			log.Println("Couldn't decompress cache entry:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 	} else {
-		status, respJson = requestToResponseBytes(ep2pool[target_url], requestJson)
+		status, respJson = requestToResponseBytes(ctx, ep2pool[target_url], requestJson)
 		if status != http.StatusOK {
 			http.Error(w, http.StatusText(status), status)
 			return
 		}
-		err := jsonit.Unmarshal(respJson, &resp)
-		if err != nil {
+		var ok bool
+		respJson, ok = formatRESTResponse(respJson)
+		if !ok {
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
-		respreal = resp
-		if resp["result"] == nil {
-			if resp["error"] != nil {
-				respreal, _ = (resp["error"]).(map[string]interface{})
-			}
+		if headStateMethods[api_method] {
+			respcache.Set(key, newCacheEntry(respJson), headStateCacheTime)
+			trackHeadState(key, target_url, api_method, requestJson, true)
 		} else {
-			var ok bool
-			respreal, ok = (resp["result"]).(map[string]interface{})
-			if !ok {
-				respreal = resp
-				delete(respreal, "id")
-				delete(respreal, "jsonrpc")
-			}
+			respcache.SetDefault(key, newCacheEntry(respJson))
 		}
-		respJson, _ = json.MarshalIndent(respreal, "", "  ")
-		respcache.SetDefault(key, respJson)
 		gcached = false
 	}
 
@@ -243,29 +362,166 @@ func doHandleREST(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Converts an upstream json RPC response to the REST form: the result (or error) alone, indented.
+func formatRESTResponse(respJson []byte) ([]byte, bool) {
+	// The result is only indented, never decoded, so that large results are not held in memory as objects.
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := jsonit.Unmarshal(respJson, &resp); err != nil {
+		return nil, false
+	}
+	realJson := respJson
+	switch {
+	case len(resp.Result) > 0 && string(resp.Result) != "null":
+		if resp.Result[0] == '{' {
+			realJson = resp.Result
+		} else {
+			realJson = append(append([]byte(`{"result":`), resp.Result...), '}')
+		}
+	case len(resp.Error) > 0 && string(resp.Error) != "null":
+		realJson = []byte("null")
+		if resp.Error[0] == '{' {
+			realJson = resp.Error
+		}
+	}
+	var out bytes.Buffer
+	out.Grow(len(realJson) + len(realJson)/4)
+	if err := json.Indent(&out, realJson, "", "  "); err != nil {
+		return nil, false
+	}
+	return out.Bytes(), true
+}
+
 // Handles an incoming http request, in standard hive json RPC format. Is normalized then sent to the appropriate endpoint.
 func doHandleReg(w http.ResponseWriter, r *http.Request) {
 	mark := time.Now()
 
-	// Unpack request into json.
-	var f interface{}
-	err := jsonit.NewDecoder(r.Body).Decode(&f)
-	switch {
-	case err == io.EOF:
+	if websocket.IsWebSocketUpgrade(r) {
+		doHandleWS(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		log.Println("Couldn't read request body.")
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
 		respmessage := map[string]string{"status": "OK", "jussi_num": "-1", "info": "For information on how to use this api, visit https://developers.hive.io/apidefinitions/ "}
 		w.Header().Set("Content-Type", "application/json")
 		jsonit.NewEncoder(w).Encode(respmessage)
 		return
-	case err != nil:
+	}
+
+	// Serve repeated requests straight from the cache, without decoding them.
+	raw, rawok := scanRawRequest(body)
+	if rawok {
+		if ce, found := lookupRawRequest(raw); found {
+			if writeCachedRPCResponse(w, r, ce, raw.id, raw.arrayreq) {
+				if debug {
+					log.Println(time.Since(mark), "raw", string(body))
+				}
+				return
+			}
+		}
+	}
+
+	reqmessage, arrayreq, status := decodeRPCMessage(body)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	call, status := normalizeRequest(reqmessage)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	id := raw.id
+	if !rawok {
+		id, _ = jsonit.Marshal(call.id)
+	}
+	serveCall(w, r, call, id, arrayreq, raw, rawok, mark)
+}
+
+// Serves a normalized call, writing the response with the client's id. Its raw request is remembered if rawok.
+func serveCall(w http.ResponseWriter, r *http.Request, call rpcCall, id []byte, arrayreq bool, raw rawRequest, rawok bool, mark time.Time) {
+	// Projected responses are not relayed, nor kept for raw lookups, which would give back the full response.
+	if call.fields != nil {
+		ctx := jobContext(r.Context(), clientIdentity(r), call.method)
+		status, respJson, gcached := fetchResponse(ctx, call)
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if !gcached {
+			checkDatabaseLock(call, respJson)
+		}
+		if !writeRPCResponse(w, respJson, id, arrayreq) {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logCall(call, mark, gcached)
+		return
+	}
+
+	ce, gcached := cachedResponse(call)
+	if !gcached {
+		// Relay the response as it arrives, keeping it for the cache if it is not too large.
+		ctx := jobContext(r.Context(), clientIdentity(r), call.method)
+		status, respJson := relayResponse(ctx, w, call, id, arrayreq)
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if respJson != nil {
+			storeResponse(call, respJson)
+			if rawok {
+				storeRawRequest(raw, call)
+			}
+			checkDatabaseLock(call, respJson)
+		}
+		logCall(call, mark, gcached)
+		return
+	}
+	if rawok {
+		storeRawRequest(raw, call)
+	}
+
+	// Finalize reply, giving back the client's id, and write.
+	if !writeCachedRPCResponse(w, r, ce, id, arrayreq) {
+		respJson, err := ce.bytes()
+		if err != nil {
+			log.Println("Couldn't decompress cache entry:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if arrayreq {
+			jsonit.NewEncoder(w).Encode([]interface{}{restoreID(call, respJson)})
+		} else {
+			jsonit.NewEncoder(w).Encode(restoreID(call, respJson))
+		}
+	}
+
+	logCall(call, mark, gcached)
+}
+
+// Decodes a request body: a single json RPC request, or a batch of one.
+func decodeRPCMessage(body []byte) (map[string]interface{}, bool, int) {
+	// Unpack request into json.
+	var f interface{}
+	if err := jsonit.Unmarshal(body, &f); err != nil {
 		log.Println("Couldn't unpack json.")
 		log.Println(err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+		return nil, false, http.StatusBadRequest
 	}
-	defer func() {
-		io.Copy(io.Discard, r.Body)
-		r.Body.Close()
-	}()
 	var reqmessage map[string]interface{}
 	var ok bool
 	arrayreq := false
@@ -273,27 +529,44 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 	reqmessage, ok = f.(map[string]interface{})
 	if !ok {
 		newf, ok := f.([]interface{})
-		if !ok {
+		if !ok || len(newf) == 0 {
 			log.Println("Couldn't type outer json")
 			log.Println(f)
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+			return nil, false, http.StatusBadRequest
 		}
 		reqmessage, ok = newf[0].(map[string]interface{})
 		if !ok {
 			log.Println("Couldn't type inner json")
 			log.Println(newf)
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+			return nil, false, http.StatusBadRequest
 		}
-		if len(f.([]interface{})) > 1 {
-			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
-			return
+		if len(newf) > 1 {
+			return nil, false, http.StatusRequestEntityTooLarge
 		}
 		arrayreq = true
 	}
+	return reqmessage, arrayreq, http.StatusOK
+}
+
+// A json RPC request after normalization, ready to be sent to its upstream.
+type rpcCall struct {
+	// The normalized request, with id "0". Also the cache key.
+	requestJson []byte
+	target      string
+	// Method name without its api, used to look up the cache time.
+	method string
+	// The block a block method is about, or 0.
+	blockNum int64
+	// The id the client sent, to be restored in the response.
+	id interface{}
+	// The parts of the result the client asked for, or nil for all of it.
+	fields projection
+}
+
+// Normalizes a single json RPC request message and maps it to the appropriate upstream.
+// Returns a non-OK status if the request is malformed or not allowed.
+func normalizeRequest(reqmessage map[string]interface{}) (rpcCall, int) {
+	var call rpcCall
 
 	// add jsonrpc if not in message
 	if _, ok := reqmessage["jsonrpc"]; !ok {
@@ -304,16 +577,25 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 		reqmessage["id"] = "0"
 	}
 
-	old_id := reqmessage["id"]
+	call.id = reqmessage["id"]
 	reqmessage["id"] = "0"
 
+	// The projection is applied to the cached response, so is not part of the request sent upstream.
+	if f, ok := reqmessage[fieldsParam]; ok {
+		delete(reqmessage, fieldsParam)
+		p, err := parseFieldsMember(f)
+		if err != nil {
+			return call, http.StatusBadRequest
+		}
+		call.fields = p
+	}
+
 	standaloneMethod := ""
 
 	method, ok := reqmessage["method"].(string)
 	if !ok {
 		log.Println("Couldn't type method")
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+		return call, http.StatusBadRequest
 	}
 
 	// Convert and sanitize request json -- map to target upstream based on request.
@@ -326,10 +608,9 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 
 	if reqmessage["method"] == "call" {
 		params, ok := reqmessage["params"].([]interface{})
-		if !ok {
+		if !ok || len(params) < 2 {
 			//log.Println("Couldn't type params from: ", reqmessage)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+			return call, http.StatusBadRequest
 		}
 		if params[0] == 0 {
 			params[0] = "database_api"
@@ -339,8 +620,7 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 		cond_meth, ok := params[1].(string)
 		if !ok {
 			log.Println("Couldn't type condenser params from: ", reqmessage)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+			return call, http.StatusBadRequest
 		}
 		standaloneMethod = cond_meth
 
@@ -382,11 +662,10 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 					reqmessage["params"] = callparams
 				}
 				if cond_meth == "get_account_history" {
-					if len(callparams) >= 2 {
+					if len(callparams) >= 3 {
 						mnum64, mok64 := MaybeGetInt64(callparams[2])
 						if mok64 && mnum64 > 10000 {
-							http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
-							return
+							return call, http.StatusRequestEntityTooLarge
 						}
 					}
 				}
@@ -394,15 +673,13 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 				cond_api, ok := params[0].(string)
 				if !ok {
 					//log.Println("Couldn't type appbase params from: ", reqmessage)
-					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-					return
+					return call, http.StatusBadRequest
 				}
 				reqmessage["method"] = cond_api + "." + cond_meth
 				reqmessage["params"] = callparams
 			default:
 				log.Println("Couldn't type call params")
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
+				return call, http.StatusBadRequest
 			}
 		}
 	}
@@ -411,13 +688,12 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 	if reqmessage["method"] == "condenser_api.get_account_history" {
 		params, ok := reqmessage["params"].([]interface{})
 		if !ok {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return call, http.StatusBadRequest
 		}
-		if len(params) >= 2 {
+		if len(params) >= 3 {
 			mnum64, mok64 := MaybeGetInt64(params[2])
 			if mok64 && mnum64 > 10000 {
-				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
-				return
+				return call, http.StatusRequestEntityTooLarge
 			}
 		}
 	}
@@ -426,19 +702,18 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 	if reqmessage["method"] == "block_api.get_block_range" {
 		params, ok := reqmessage["params"].(map[string]interface{})
 		if !ok {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return call, http.StatusBadRequest
 		}
 		bcnt, ok := params["count"]
 		if !ok {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return call, http.StatusBadRequest
 		}
 		ibcnt, ok := MaybeGetInt64(bcnt)
 		if !ok {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return call, http.StatusBadRequest
 		}
 		if ibcnt != 1 {
-			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
-			return
+			return call, http.StatusRequestEntityTooLarge
 		}
 	}
 
@@ -482,11 +757,12 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 				params, ok := reqmessage["params"].([]interface{})
 				if ok {
 					if len(params) >= 1 {
-						lmatch, _ := regexp.MatchString(`^\/?(~?witnesses|proposals)$`, params[0].(string))
+						pp, _ := params[0].(string)
+						lmatch, _ := regexp.MatchString(`^\/?(~?witnesses|proposals)$`, pp)
 						if lmatch {
 							target_url = liteep
 						}
-						match, _ := regexp.MatchString(`/@[^/]+/transfers`, params[0].(string))
+						match, _ := regexp.MatchString(`/@[^/]+/transfers`, pp)
 						if match {
 							target_url = fullep
 						}
@@ -501,71 +777,173 @@ func doHandleReg(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Println("Couldn't re-marshal request")
 		log.Println(err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+		return call, http.StatusBadRequest
+	}
+
+	call.requestJson = requestJson
+	call.target = target_url
+	call.method = standaloneMethod
+	if blockMethods[standaloneMethod] {
+		params := reqmessage["params"]
+		// Calls keep their condenser params after the api and method: ["condenser_api", "get_block", [n]].
+		if reqmessage["method"] == "call" {
+			params = nil
+			if p, ok := reqmessage["params"].([]interface{}); ok && len(p) > 2 {
+				params = p[2]
+			}
+		}
+		call.blockNum = requestBlockNum(params)
 	}
+	return call, http.StatusOK
+}
 
-	// Have both request and target here.
-	var resp map[string]interface{}
-	var respJson []byte
-	key := string(requestJson)
-	var status int
-	var gcached bool
-	if x, found := respcache.Get(key); found {
-		respJson = x.([]byte)
-		gcached = true
-	} else {
-		status, respJson = requestToResponseBytes(ep2pool[target_url], requestJson)
-		if status != http.StatusOK {
-			http.Error(w, http.StatusText(status), status)
-			return
-		}
-		if mCacheTime, fnd := cacheTime[standaloneMethod]; fnd {
-			respcache.Set(key, respJson, time.Duration(mCacheTime)*time.Second)
-		} else {
-			respcache.SetDefault(key, respJson)
+// Block number from the params of a block method: {"block_num": n} for appbase, or [n, ...] for condenser.
+func requestBlockNum(params interface{}) int64 {
+	var numberish interface{}
+	switch p := params.(type) {
+	case map[string]interface{}:
+		numberish = p["block_num"]
+	case []interface{}:
+		if len(p) > 0 {
+			numberish = p[0]
 		}
-		gcached = false
 	}
+	num, ok := MaybeGetInt64(numberish)
+	if !ok {
+		return 0
+	}
+	return num
+}
 
-	// Finalize reply, convert back from json, and write.
-	if old_id != "0" || arrayreq {
-		jsonit.Unmarshal(respJson, &resp)
-		resp["id"] = old_id
-
-		// Check for database lock error.
-		if val, in := resp["error"]; in {
-			if valmap, ok := val.(map[string]interface{}); ok {
-				if codei, ok := jsoniter.CastJsonNumber(valmap["code"]); ok {
-					if i, err := strconv.Atoi(codei); err != nil && i == -32003 { // database lock
-						log.Println("Req errored: ", val)
-						log.Println("From: ", string(requestJson))
-					}
-				}
-			}
+// How long to cache the response to a call.
+func cacheTTL(call rpcCall) time.Duration {
+	if call.blockNum > 0 && call.blockNum <= head.lastIrreversible() {
+		return irreversibleCacheTime * time.Second
+	}
+	if headStateMethods[call.method] {
+		return headStateCacheTime
+	}
+	if mCacheTime, fnd := cacheTime[call.method]; fnd {
+		return time.Duration(mCacheTime) * time.Second
+	}
+	return cache.DefaultExpiration
+}
+
+// Gets the response to a normalized call, from the cache or from its upstream.
+func fetchResponse(ctx context.Context, call rpcCall) (int, []byte, bool) {
+	if call.fields != nil {
+		return fetchProjectedResponse(ctx, call)
+	}
+	if ce, found := cachedResponse(call); found {
+		if respJson, err := ce.bytes(); err == nil {
+			return http.StatusOK, respJson, true
 		}
 	}
-	w.Header().Set("Content-Type", "application/json")
+	status, respJson := requestToResponseBytes(ctx, ep2pool[call.target], call.requestJson)
+	if status != http.StatusOK {
+		return status, nil, false
+	}
+	storeResponse(call, respJson)
+	return http.StatusOK, respJson, false
+}
+
+// The cached response for a normalized request, if there is one.
+func cachedResponse(call rpcCall) (cacheEntry, bool) {
+	key := string(call.requestJson)
+	x, found := respcache.Get(key)
+	if !found {
+		return cacheEntry{}, false
+	}
+	if headStateMethods[call.method] {
+		touchHeadState(key)
+	}
+	return x.(cacheEntry), true
+}
+
+// Caches a response fetched for a normalized request.
+func storeResponse(call rpcCall, respJson []byte) {
+	key := string(call.requestJson)
+	respcache.Set(key, newCacheEntry(respJson), cacheTTL(call))
+	if headStateMethods[call.method] {
+		trackHeadState(key, call.target, call.method, call.requestJson, false)
+	}
+}
 
+// Decodes a normalized response and gives it back the id the client sent.
+func restoreID(call rpcCall, respJson []byte) map[string]interface{} {
+	var resp map[string]interface{}
+	if err := jsonit.Unmarshal(respJson, &resp); err != nil || resp == nil {
+		log.Println("Couldn't unpack response from: ", call.target)
+		resp = map[string]interface{}{"jsonrpc": "2.0", "error": statusRPCError(http.StatusBadGateway)}
+	}
+	resp["id"] = call.id
+	return resp
+}
+
+// Logs upstream database lock errors.
+func checkDatabaseLock(call rpcCall, respJson []byte) {
+	if !bytes.Contains(respJson, []byte("-32003")) {
+		return
+	}
+	var resp rpcResponse
+	if err := jsonit.Unmarshal(respJson, &resp); err != nil || resp.Error == nil {
+		return
+	}
+	if resp.Error.Code == -32003 { // database lock
+		log.Println("Req errored: ", resp.Error)
+		log.Println("From: ", string(call.requestJson))
+	}
+}
+
+// Writes a cached response, as stored if the client accepts its encoding and it needs no id, otherwise with the
+// client's id spliced in. Returns false, having written nothing, if that could not be done.
+func writeCachedRPCResponse(w http.ResponseWriter, r *http.Request, ce cacheEntry, id []byte, arrayreq bool) bool {
+	if !arrayreq && bytes.Equal(id, defaultRawID) && writeEncoded(w, r, ce) {
+		return true
+	}
+	respJson, err := ce.bytes()
+	if err != nil {
+		return false
+	}
+	return writeRPCResponse(w, respJson, id, arrayreq)
+}
+
+// Writes a response with the client's id spliced in, as the only element of a batch if the request was one.
+// Returns false, having written nothing, if the response could not be spliced.
+func writeRPCResponse(w http.ResponseWriter, respJson []byte, id []byte, arrayreq bool) bool {
+	out, ok := spliceID(respJson, id)
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
 	if arrayreq {
-		var rmm []interface{}
-		rmm = append(rmm, resp)
-		jsonit.NewEncoder(w).Encode(rmm)
+		w.Write([]byte{'['})
+		w.Write(out)
+		w.Write([]byte{']'})
 	} else {
-		if old_id != "0" {
-			jsonit.NewEncoder(w).Encode(resp)
-		} else {
-			w.Write(respJson)
-		}
+		w.Write(out)
+	}
+	return true
+}
+
+// A json RPC error object for a request that failed with the given http status.
+func statusRPCError(status int) *rpcError {
+	code := int64(-32603) // Internal error
+	if status >= 400 && status < 500 {
+		code = -32600 // Invalid request
 	}
+	return &rpcError{Code: code, Message: http.StatusText(status)}
+}
 
+// Logs a served call: always if it was slow, and every call in debug mode.
+func logCall(call rpcCall, mark time.Time, gcached bool) {
 	elapsed := time.Since(mark)
 
 	if int(elapsed/time.Second) >= 5 {
-		log.Println("LONG:", elapsed, gcached, target_url, "-d '"+string(requestJson)+"'")
+		log.Println("LONG:", elapsed, gcached, call.target, "-d '"+string(call.requestJson)+"'")
 	}
 
 	if debug {
-		log.Println(elapsed, gcached, target_url, "-d '"+string(requestJson)+"'")
+		log.Println(elapsed, gcached, call.target, "-d '"+string(call.requestJson)+"'")
 	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/patrickmn/go-cache"
+)
+
+// Query parameters of a json RPC request sent as a GET.
+const (
+	rpcMethodParam  = "method"
+	rpcParamsParam  = "params"
+	rpcIDParam      = "id"
+	rpcRequestParam = "request"
+)
+
+// Serves json RPC requests sent as a GET, so that their responses can be cached by standard CDNs and proxies on the url.
+// The request is given either as its members, /rpc?method=condenser_api.get_block&params=[1], or whole as base64 json,
+// /rpc?request=eyJqc29ucnBj... Either way it is normalized, routed and cached just as if it had been posted.
+// Other requests, and websockets, are served as usual.
+func doHandleGetRPC(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || websocket.IsWebSocketUpgrade(r) {
+		doHandleReg(w, r)
+		return
+	}
+	mark := time.Now()
+
+	reqmessage, arrayreq, status := getRPCMessage(r)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	call, status := normalizeRequest(reqmessage)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	// A GET must be safe to repeat or prefetch, so cannot broadcast.
+	if broadcastMethods[call.method] {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The response is had whole rather than relayed, so that errors are known before the cache headers are written.
+	ctx := jobContext(r.Context(), clientIdentity(r), call.method)
+	status, respJson, gcached := fetchResponse(ctx, call)
+	if status != http.StatusOK {
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if !gcached {
+		checkDatabaseLock(call, respJson)
+	}
+
+	// Cached downstream for as long as the response is cached here, unless it is an error.
+	if hasRPCError(respJson) {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		ttl := cacheTTL(call)
+		if ttl == cache.DefaultExpiration {
+			ttl = respCacheTime
+		}
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(ttl/time.Second)))
+	}
+
+	id, _ := jsonit.Marshal(call.id)
+	if !writeRPCResponse(w, respJson, id, arrayreq) {
+		w.Header().Set("Content-Type", "application/json")
+		if arrayreq {
+			jsonit.NewEncoder(w).Encode([]interface{}{restoreID(call, respJson)})
+		} else {
+			jsonit.NewEncoder(w).Encode(restoreID(call, respJson))
+		}
+	}
+	logCall(call, mark, gcached)
+}
+
+// Methods that broadcast, of condenser_api or network_broadcast_api. These are fixed, rather than taken from the
+// method classes that -P may change.
+var broadcastMethods = map[string]bool{
+	"broadcast_block":                   true,
+	"broadcast_transaction":             true,
+	"broadcast_transaction_synchronous": true,
+}
+
+// Whether a json RPC response carries an error. Responses that cannot be scanned are taken to.
+func hasRPCError(respJson []byte) bool {
+	obj := bytes.TrimSpace(respJson)
+	if len(obj) == 0 || obj[0] != '{' {
+		return true
+	}
+	start, end, ok := objectField(obj, "error")
+	return !ok || (start >= 0 && string(obj[start:end]) != "null")
+}
+
+// The json RPC request of a GET's query.
+func getRPCMessage(r *http.Request) (map[string]interface{}, bool, int) {
+	q := r.URL.Query()
+	if q.Has(rpcRequestParam) {
+		if q.Has(rpcMethodParam) || q.Has(rpcParamsParam) || q.Has(rpcIDParam) {
+			return nil, false, http.StatusBadRequest
+		}
+		body, err := decodeBase64(q.Get(rpcRequestParam))
+		if err != nil {
+			return nil, false, http.StatusBadRequest
+		}
+		return decodeRPCMessage(body)
+	}
+
+	method := q.Get(rpcMethodParam)
+	if method == "" {
+		return nil, false, http.StatusBadRequest
+	}
+	reqmessage := map[string]interface{}{"jsonrpc": "2.0", "method": method}
+	if q.Has(rpcParamsParam) {
+		var params interface{}
+		if err := jsonit.UnmarshalFromString(q.Get(rpcParamsParam), &params); err != nil {
+			return nil, false, http.StatusBadRequest
+		}
+		reqmessage["params"] = params
+	}
+	if q.Has(rpcIDParam) {
+		// An id that is not json is taken as a string.
+		var id interface{}
+		if err := jsonit.UnmarshalFromString(q.Get(rpcIDParam), &id); err != nil {
+			id = q.Get(rpcIDParam)
+		}
+		reqmessage["id"] = id
+	}
+	if q.Has(fieldsParam) {
+		reqmessage[fieldsParam] = strings.Join(q[fieldsParam], ",")
+	}
+	return reqmessage, false, http.StatusOK
+}
+
+// Decodes base64 in either the url safe or standard alphabet, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
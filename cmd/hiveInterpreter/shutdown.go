@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Process exit statuses.
+const (
+	exitOK           = 0
+	exitServeError   = 1
+	exitDrainTimeout = 2
+)
+
+// Cancelled when shutdown begins, to end long-lived streams and stop background pollers.
+var shutdownCtx, beginShutdown = context.WithCancel(context.Background())
+
+// Background goroutines that submit jobs to the pools. These must finish before the pools are drained.
+var backgroundJobs sync.WaitGroup
+
+// Serves until SIGTERM or SIGINT is received (or serving fails), then shuts down gracefully: stops accepting
+// new connections, lets in-flight requests and queued upstream jobs finish within the deadline, flushes the
+// log and removes the socket. On SIGUSR2 the sockets are first handed off to a newly started process, and are
+// left in place. Returns the exit status for the process.
+func serveUntilSignalled(handler http.Handler, listeners []*serveListener, deadline time.Duration, logFile *os.File) int {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+
+	// Each listener gets its own server, applying its policy.
+	servers := make([]*http.Server, len(listeners))
+	serveErr := make(chan error, len(listeners))
+	for i, sl := range listeners {
+		srv := &http.Server{Handler: policyHandler(sl.policy, handler)}
+		if sl.certs != nil {
+			srv.TLSConfig = &tls.Config{GetCertificate: sl.certs.getCertificate}
+		} else {
+			// Cleartext listeners accept HTTP/2 with prior knowledge (h2c) alongside HTTP/1.1.
+			srv.Protocols = new(http.Protocols)
+			srv.Protocols.SetHTTP1(true)
+			srv.Protocols.SetUnencryptedHTTP2(true)
+		}
+		servers[i] = srv
+		go func(srv *http.Server, sl *serveListener) {
+			if sl.certs != nil {
+				serveErr <- srv.ServeTLS(sl.Listener, "", "")
+			} else {
+				serveErr <- srv.Serve(sl.Listener)
+			}
+		}(srv, sl)
+		log.Println("Listening on", sl.name, "with policy", sl.policy.name)
+	}
+	notifyReady()
+
+	code := exitOK
+wait:
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGUSR2 {
+				if err := handoff(listeners); err != nil {
+					log.Println("Handoff failed, continuing to serve:", err)
+					continue
+				}
+				for _, sl := range listeners {
+					sl.owned = false
+				}
+			}
+			log.Println("Received", sig, "- shutting down, draining for up to", deadline)
+			break wait
+		case err := <-serveErr:
+			log.Println("Serve:", err)
+			code = exitServeError
+			break wait
+		}
+	}
+	// A second signal falls back to the default behaviour, terminating immediately.
+	signal.Stop(sigs)
+	beginShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	// Close the listeners and wait for in-flight requests, including over websockets. Only once no handler can submit more work are the pools drained.
+	var shutdownErr error
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				mu.Lock()
+				shutdownErr = err
+				mu.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	if shutdownErr == nil {
+		// Websocket connections are not tracked by the servers.
+		shutdownErr = closeWebSockets(ctx)
+	}
+	if shutdownErr == nil {
+		shutdownErr = waitGroupContext(ctx, &backgroundJobs)
+	}
+	if shutdownErr != nil {
+		log.Println("Shutdown:", shutdownErr)
+		code = exitDrainTimeout
+	} else {
+		for ep, jobp := range ep2pool {
+			if err := jobp.drain(ctx); err != nil {
+				log.Println("Draining upstream "+ep+":", err)
+				code = exitDrainTimeout
+			}
+		}
+	}
+
+	for _, sl := range listeners {
+		sl.cleanup()
+	}
+	log.Println("Shut down with status", code)
+	if logFile != nil {
+		logFile.Sync()
+		logFile.Close()
+	}
+	return code
+}
+
+// Waits for the group, or until the context is done.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
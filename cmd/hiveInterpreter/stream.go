@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Most blocks fetched in one go when the streamer falls behind. Older blocks are skipped.
+	streamMaxCatchUp = 20
+	// Blocks buffered per subscriber. A subscriber that falls further behind is disconnected.
+	streamSubscriberBuffer = 32
+	// Comment line sent to idle streams, so that proxies keep the connection open.
+	streamHeartbeat = 15 * time.Second
+)
+
+// A block fetched by the streamer, prepared once for every subscriber.
+type streamBlock struct {
+	num    int64
+	full   []byte // Event data for the whole block.
+	header []byte // Event data for the header only.
+	ops    []streamOp
+}
+
+// An operation event, with what its subscribers filter on.
+type streamOp struct {
+	typ      string
+	accounts []string // Accounts named by the operation's account fields.
+	id       string
+	data     []byte
+}
+
+// Follows the head tracker, fetching each new block once through the lite pool and fanning it out to all subscribers.
+// Runs only while there are subscribers.
+type blockStreamer struct {
+	mu      sync.Mutex
+	subs    map[chan *streamBlock]bool
+	running bool
+}
+
+var streamer = &blockStreamer{subs: make(map[chan *streamBlock]bool)}
+
+// Fields of operations that name accounts, used to filter the operation stream by account.
+var opAccountFields = map[string]bool{
+	"account":                true,
+	"author":                 true,
+	"parent_author":          true,
+	"voter":                  true,
+	"from":                   true,
+	"to":                     true,
+	"owner":                  true,
+	"creator":                true,
+	"new_account_name":       true,
+	"delegator":              true,
+	"delegatee":              true,
+	"proxy":                  true,
+	"producer":               true,
+	"witness":                true,
+	"curator":                true,
+	"receiver":               true,
+	"agent":                  true,
+	"who":                    true,
+	"from_account":           true,
+	"to_account":             true,
+	"publisher":              true,
+	"required_auths":         true,
+	"required_posting_auths": true,
+}
+
+// Adds a subscriber, starting the poller if needed. Fails once shutting down.
+func (bs *blockStreamer) subscribe() (chan *streamBlock, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if shutdownCtx.Err() != nil {
+		return nil, false
+	}
+	ch := make(chan *streamBlock, streamSubscriberBuffer)
+	bs.subs[ch] = true
+	if !bs.running {
+		bs.running = true
+		backgroundJobs.Add(1)
+		go bs.run()
+	}
+	return ch, true
+}
+
+func (bs *blockStreamer) unsubscribe(ch chan *streamBlock) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.subs[ch] {
+		delete(bs.subs, ch)
+		close(ch)
+	}
+}
+
+// Sends a block to every subscriber, dropping those that are too far behind.
+func (bs *blockStreamer) publish(sb *streamBlock) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for ch := range bs.subs {
+		select {
+		case ch <- sb:
+		default:
+			delete(bs.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Fetch loop. Exits once there are no subscribers left, or on shutdown.
+func (bs *blockStreamer) run() {
+	defer backgroundJobs.Done()
+
+	last := int64(0)
+	for {
+		bs.mu.Lock()
+		if len(bs.subs) == 0 {
+			bs.running = false
+			bs.mu.Unlock()
+			return
+		}
+		bs.mu.Unlock()
+
+		// Wait for the next block before fetching, except on startup.
+		next := head.nextBlock()
+		dgp, err := currentHead(context.Background(), ep2pool[liteep])
+		if err != nil {
+			log.Println("Stream: getting head block:", err)
+		} else {
+			headNum := dgp.HeadBlockNumber
+			if last == 0 || headNum-last > streamMaxCatchUp {
+				last = headNum - 1
+			}
+			for last < headNum {
+				sb, err := fetchStreamBlock(last + 1)
+				if err != nil {
+					log.Println("Stream: getting block", last+1, err)
+					break
+				}
+				bs.publish(sb)
+				last++
+			}
+		}
+
+		select {
+		case <-next:
+		case <-time.After(headMaxAge):
+		case <-shutdownCtx.Done():
+			bs.mu.Lock()
+			for ch := range bs.subs {
+				delete(bs.subs, ch)
+				close(ch)
+			}
+			bs.running = false
+			bs.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Fetches a block from the lite upstream and prepares its stream events.
+func fetchStreamBlock(num int64) (*streamBlock, error) {
+	reqmessage := map[string]interface{}{"id": "0", "jsonrpc": "2.0", "method": "block_api.get_block", "params": map[string]interface{}{"block_num": num}}
+	var result struct {
+		Block json.RawMessage `json:"block"`
+	}
+	if err := requestToResult(context.Background(), ep2pool[liteep], reqmessage, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Block) == 0 {
+		return nil, newStatusError(http.StatusNotFound, "")
+	}
+	var block signedBlock
+	if err := jsonit.Unmarshal(result.Block, &block); err != nil {
+		return nil, err
+	}
+
+	full, err := jsonit.Marshal(map[string]interface{}{"block_num": num, "block": result.Block})
+	if err != nil {
+		return nil, err
+	}
+	header, err := jsonit.Marshal(map[string]interface{}{"block_num": num, "block_id": block.BlockID, "previous": block.Previous, "timestamp": block.Timestamp, "witness": block.Witness})
+	if err != nil {
+		return nil, err
+	}
+	ops, err := streamOps(num, &block)
+	if err != nil {
+		return nil, err
+	}
+	return &streamBlock{num: num, full: full, header: header, ops: ops}, nil
+}
+
+// Prepares the events for the operations in a block.
+func streamOps(num int64, block *signedBlock) ([]streamOp, error) {
+	var ops []streamOp
+	for ti, trx := range block.Transactions {
+		trxID := ""
+		if ti < len(block.TransactionIDs) {
+			trxID = block.TransactionIDs[ti]
+		}
+		for oi, op := range trx.Operations {
+			data, err := jsonit.Marshal(map[string]interface{}{
+				"block_num":    num,
+				"trx_id":       trxID,
+				"trx_in_block": ti,
+				"op_in_trx":    oi,
+				"timestamp":    block.Timestamp,
+				"op":           op,
+			})
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, streamOp{
+				typ:      op.Type,
+				accounts: opAccounts(op),
+				id:       strconv.FormatInt(num, 10) + "-" + strconv.Itoa(ti) + "-" + strconv.Itoa(oi),
+				data:     data,
+			})
+		}
+	}
+	return ops, nil
+}
+
+// The accounts named by an operation's account fields.
+func opAccounts(op operation) []string {
+	var fields map[string]interface{}
+	if err := jsonit.Unmarshal(op.Value, &fields); err != nil {
+		return nil
+	}
+	var accounts []string
+	for k, v := range fields {
+		if !opAccountFields[k] {
+			continue
+		}
+		switch acc := v.(type) {
+		case string:
+			accounts = append(accounts, acc)
+		case []interface{}:
+			for _, a := range acc {
+				if s, ok := a.(string); ok {
+					accounts = append(accounts, s)
+				}
+			}
+		}
+	}
+	return accounts
+}
+
+// Filters for the operation stream. Empty filters match everything.
+type opFilter struct {
+	types    map[string]bool
+	accounts map[string]bool
+}
+
+// Parses comma separated types= and accounts= filters. Types may be given with or without the _operation suffix.
+func parseOpFilter(q map[string][]string) opFilter {
+	var f opFilter
+	for _, v := range q["types"] {
+		for _, t := range strings.Split(v, ",") {
+			if t == "" {
+				continue
+			}
+			if f.types == nil {
+				f.types = make(map[string]bool)
+			}
+			if !strings.HasSuffix(t, "_operation") {
+				t += "_operation"
+			}
+			f.types[t] = true
+		}
+	}
+	for _, v := range q["accounts"] {
+		for _, a := range strings.Split(v, ",") {
+			if a == "" {
+				continue
+			}
+			if f.accounts == nil {
+				f.accounts = make(map[string]bool)
+			}
+			f.accounts[a] = true
+		}
+	}
+	return f
+}
+
+func (f opFilter) matches(op streamOp) bool {
+	if f.types != nil && !f.types[op.typ] {
+		return false
+	}
+	if f.accounts == nil {
+		return true
+	}
+	for _, acc := range op.accounts {
+		if f.accounts[acc] {
+			return true
+		}
+	}
+	return false
+}
+
+// Streams new blocks (/v1/stream/blocks, optionally ?header_only=true) or their operations
+// (/v1/stream/ops, optionally filtered by ?types=transfer,vote&accounts=alice,bob) as server-sent events.
+func doHandleStream(w http.ResponseWriter, r *http.Request) {
+	kind := path.Base(r.URL.Path)
+	if kind != "blocks" && kind != "ops" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	headerOnly, _ := strconv.ParseBool(q.Get("header_only"))
+	filter := parseOpFilter(q)
+
+	sub, ok := streamer.subscribe()
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer streamer.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case sb, ok := <-sub:
+			if !ok {
+				// Too slow to keep up, or shutting down.
+				return
+			}
+			var err error
+			if kind == "blocks" {
+				data := sb.full
+				if headerOnly {
+					data = sb.header
+				}
+				err = writeEvent(w, "block", strconv.FormatInt(sb.num, 10), data)
+			} else {
+				err = writeOpEvents(w, sb, filter)
+			}
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// Writes an event for each operation in the block that passes the filter.
+func writeOpEvents(w http.ResponseWriter, sb *streamBlock, filter opFilter) error {
+	for _, op := range sb.ops {
+		if !filter.matches(op) {
+			continue
+		}
+		if err := writeEvent(w, "op", op.id, op.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEvent(w http.ResponseWriter, event string, id string, data []byte) error {
+	_, err := w.Write([]byte("event: " + event + "\nid: " + id + "\ndata: " + string(data) + "\n\n"))
+	return err
+}
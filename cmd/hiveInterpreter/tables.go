@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Names of the REST query parameters choosing the output format of a list result, and its columns.
+const (
+	formatParam  = "format"
+	columnsParam = "columns"
+)
+
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// Media types of the formats, as sent, and as they may be asked for in Accept.
+var formatTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatNDJSON: "application/x-ndjson",
+}
+
+var acceptFormats = map[string]string{
+	"application/json":     formatJSON,
+	"application/*":        formatJSON,
+	"*/*":                  formatJSON,
+	"text/csv":             formatCSV,
+	"application/x-ndjson": formatNDJSON,
+	"application/ndjson":   formatNDJSON,
+}
+
+// The REST query parameters, for the API document.
+var (
+	formatRestParam = restParam{name: formatParam, kind: paramString, enum: []string{formatJSON, formatCSV, formatNDJSON},
+		desc: "Output format. csv has a row per item, with nested fields as dotted columns; ndjson has an item per line. Otherwise taken from Accept."}
+	columnsRestParam = restParam{name: columnsParam, kind: paramString, array: true,
+		desc: "Columns of csv or ndjson output, in order, as dotted paths (op.type) or json pointers (/op/type) into each item."}
+)
+
+// Where the rows of a list result are.
+type restTable struct {
+	// Fields of the result holding rows, or none if the result is the list.
+	lists []string
+	// Names a column holding the list each row is from, when there are several.
+	label string
+	// Reshapes a row, if rows are not objects of their own.
+	row func(json.RawMessage) (json.RawMessage, error)
+}
+
+var restTables = map[string]restTable{
+	"block_api.get_block_range":               {lists: []string{"blocks"}},
+	"database_api.get_feed_history":           {lists: []string{"price_history"}},
+	"database_api.find_accounts":              {lists: []string{"accounts"}},
+	"database_api.list_accounts":              {lists: []string{"accounts"}},
+	"database_api.list_witnesses":             {lists: []string{"witnesses"}},
+	"database_api.find_witnesses":             {lists: []string{"witnesses"}},
+	"database_api.list_proposals":             {lists: []string{"proposals"}},
+	"database_api.find_vesting_delegations":   {lists: []string{"delegations"}},
+	"account_history_api.get_account_history": {lists: []string{"history"}, row: historyRow},
+	"account_history_api.enum_virtual_ops":    {lists: []string{"ops"}},
+	"account_history_api.get_ops_in_block":    {lists: []string{"ops"}},
+	"rc_api.find_rc_accounts":                 {lists: []string{"rc_accounts"}},
+	"reputation_api.get_account_reputations":  {lists: []string{"reputations"}},
+	"market_history_api.get_order_book":       {lists: []string{"bids", "asks"}, label: "side"},
+	"market_history_api.get_recent_trades":    {lists: []string{"trades"}},
+	"market_history_api.get_trade_history":    {lists: []string{"trades"}},
+	"bridge.get_ranked_posts":                 {},
+	"bridge.get_account_posts":                {},
+	"bridge.list_communities":                 {},
+	"bridge.get_trending_topics":              {},
+	"bridge.account_notifications":            {},
+
+	"condenser_api.get_active_witnesses":                   {},
+	"condenser_api.get_feed_history":                       {lists: []string{"price_history"}},
+	"condenser_api.get_market_history":                     {},
+	"condenser_api.get_accounts":                           {},
+	"condenser_api.lookup_account_names":                   {},
+	"condenser_api.lookup_accounts":                        {},
+	"condenser_api.get_account_history":                    {row: historyRow},
+	"condenser_api.get_account_reputations":                {},
+	"condenser_api.get_account_votes":                      {},
+	"condenser_api.get_collateralized_conversion_requests": {},
+	"condenser_api.get_conversion_requests":                {},
+	"condenser_api.get_open_orders":                        {},
+	"condenser_api.get_owner_history":                      {},
+	"condenser_api.get_savings_withdraw_from":              {},
+	"condenser_api.get_savings_withdraw_to":                {},
+	"condenser_api.find_recurrent_transfers":               {},
+	"condenser_api.get_withdraw_routes":                    {},
+	"condenser_api.get_vesting_delegations":                {},
+	"condenser_api.get_expiring_vesting_delegations":       {},
+	"condenser_api.get_ops_in_block":                       {},
+	"condenser_api.get_witnesses":                          {},
+	"condenser_api.get_witnesses_by_vote":                  {},
+	"condenser_api.lookup_witness_accounts":                {},
+	"condenser_api.find_proposals":                         {},
+	"condenser_api.get_order_book":                         {lists: []string{"bids", "asks"}, label: "side"},
+	"condenser_api.get_recent_trades":                      {},
+	"condenser_api.get_trade_history":                      {},
+	"condenser_api.get_content_replies":                    {},
+	"condenser_api.get_active_votes":                       {},
+	"condenser_api.get_reblogged_by":                       {},
+	"condenser_api.get_followers":                          {},
+	"condenser_api.get_following":                          {},
+	"condenser_api.get_blog":                               {},
+	"condenser_api.get_blog_entries":                       {},
+	"condenser_api.get_trending_tags":                      {},
+	"condenser_api.get_replies_by_last_update":             {},
+	"condenser_api.get_discussions_by_author_before_date":  {},
+	"condenser_api.get_discussions_by_trending":            {},
+	"condenser_api.get_discussions_by_hot":                 {},
+	"condenser_api.get_discussions_by_promoted":            {},
+	"condenser_api.get_discussions_by_created":             {},
+	"condenser_api.get_discussions_by_blog":                {},
+	"condenser_api.get_discussions_by_feed":                {},
+	"condenser_api.get_discussions_by_comments":            {},
+	"condenser_api.get_post_discussions_by_payout":         {},
+	"condenser_api.get_comment_discussions_by_payout":      {},
+}
+
+// History entries are [seq, op] pairs, made into the op with its seq.
+func historyRow(raw json.RawMessage) (json.RawMessage, error) {
+	var entry [2]json.RawMessage
+	if err := jsonit.Unmarshal(raw, &entry); err != nil {
+		return nil, err
+	}
+	return prependMember(entry[1], "seq", entry[0])
+}
+
+// Adds a member to the front of a json object, keeping the order of the others.
+func prependMember(obj json.RawMessage, key string, value json.RawMessage) (json.RawMessage, error) {
+	obj = bytes.TrimSpace(obj)
+	if len(obj) < 2 || obj[0] != '{' {
+		return nil, errors.New("not an object")
+	}
+	out := append([]byte("{"+strconv.Quote(key)+":"), value...)
+	if rest := bytes.TrimSpace(obj[1:]); rest[0] != '}' {
+		out = append(out, ',')
+		out = append(out, rest...)
+	} else {
+		out = append(out, '}')
+	}
+	return out, nil
+}
+
+// The output format of a REST response: the format parameter, or the best of Accept. Explicit is set when the
+// format was asked for with the parameter, rather than negotiated.
+func restFormat(r *http.Request, q url.Values) (format string, explicit bool, err error) {
+	if f := q.Get(formatParam); f != "" {
+		if _, ok := formatTypes[f]; !ok {
+			return "", false, errors.New("must be one of json, csv, ndjson")
+		}
+		return f, true, nil
+	}
+	format, best := formatJSON, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		f, ok := acceptFormats[mt]
+		if !ok {
+			continue
+		}
+		qv := 1.0
+		if s, ok := params["q"]; ok {
+			if qv, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if qv > best && qv > 0 {
+			format, best = f, qv
+		}
+	}
+	return format, false, nil
+}
+
+// A column of table output: its name as given, and its path into each row.
+type tableColumn struct {
+	name string
+	path []string
+}
+
+func parseColumns(list []string) ([]tableColumn, error) {
+	var columns []tableColumn
+	for _, entry := range list {
+		for _, name := range strings.Split(entry, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			path, err := parseFieldPath(name)
+			if err != nil {
+				return nil, err
+			}
+			if len(columns) == maxProjectionFields {
+				return nil, errors.New("too many columns, at most " + strconv.Itoa(maxProjectionFields))
+			}
+			columns = append(columns, tableColumn{name: name, path: path})
+		}
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("no columns given")
+	}
+	return columns, nil
+}
+
+// The rows of a json RPC response. Errors, and results that are not lists, have none.
+func (t restTable) rows(respJson []byte) ([]json.RawMessage, error) {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := jsonit.Unmarshal(respJson, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" {
+		return nil, errors.New("no result")
+	}
+	var rows []json.RawMessage
+	if len(t.lists) == 0 {
+		if err := jsonit.Unmarshal(resp.Result, &rows); err != nil {
+			return nil, err
+		}
+	} else {
+		var obj map[string]json.RawMessage
+		if err := jsonit.Unmarshal(resp.Result, &obj); err != nil {
+			return nil, err
+		}
+		for _, name := range t.lists {
+			var list []json.RawMessage
+			if raw, ok := obj[name]; ok {
+				if err := jsonit.Unmarshal(raw, &list); err != nil {
+					return nil, err
+				}
+			}
+			for _, row := range list {
+				if t.label != "" {
+					var err error
+					if row, err = prependMember(row, t.label, json.RawMessage(strconv.Quote(name))); err != nil {
+						return nil, err
+					}
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	if t.row != nil {
+		for i, row := range rows {
+			var err error
+			if rows[i], err = t.row(row); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rows, nil
+}
+
+// Writes rows as csv, with the given columns, or otherwise a column per nested field, in the order they first appear.
+func writeCSV(rows []json.RawMessage, columns []tableColumn) ([]byte, error) {
+	var cells []map[string]json.RawMessage
+	var header []string
+	if columns != nil {
+		for _, c := range columns {
+			header = append(header, c.name)
+		}
+		cells = make([]map[string]json.RawMessage, len(rows))
+		for i, row := range rows {
+			cells[i] = make(map[string]json.RawMessage, len(columns))
+			for _, c := range columns {
+				if v, ok := lookupPath(row, c.path); ok {
+					cells[i][c.name] = v
+				}
+			}
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, row := range rows {
+			flat, err := flattenRow("", row, nil)
+			if err != nil {
+				return nil, err
+			}
+			rowCells := make(map[string]json.RawMessage, len(flat))
+			for _, cell := range flat {
+				if !seen[cell.name] {
+					seen[cell.name] = true
+					header = append(header, cell.name)
+				}
+				rowCells[cell.name] = cell.value
+			}
+			cells = append(cells, rowCells)
+		}
+	}
+
+	var out bytes.Buffer
+	cw := csv.NewWriter(&out)
+	record := make([]string, len(header))
+	for i, name := range header {
+		record[i] = csvSafe(name)
+	}
+	cw.Write(record)
+	for _, rowCells := range cells {
+		for i, name := range header {
+			record[i] = cellText(rowCells[name])
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return out.Bytes(), cw.Error()
+}
+
+// Writes rows as newline delimited json, each with the given columns, or whole.
+func writeNDJSON(rows []json.RawMessage, columns []tableColumn) ([]byte, error) {
+	var out bytes.Buffer
+	for _, row := range rows {
+		if columns == nil {
+			if err := json.Compact(&out, row); err != nil {
+				return nil, err
+			}
+			out.WriteByte('\n')
+			continue
+		}
+		out.WriteByte('{')
+		first := true
+		for _, c := range columns {
+			v, ok := lookupPath(row, c.path)
+			if !ok {
+				continue
+			}
+			if !first {
+				out.WriteByte(',')
+			}
+			first = false
+			out.WriteString(strconv.Quote(c.name) + ":")
+			if err := json.Compact(&out, v); err != nil {
+				return nil, err
+			}
+		}
+		out.WriteString("}\n")
+	}
+	return out.Bytes(), nil
+}
+
+type tableCell struct {
+	name  string
+	value json.RawMessage
+}
+
+// Flattens the nested objects of a row into cells named by their dotted paths, in order. Arrays are kept as json,
+// and a row that is not an object is a single value cell.
+func flattenRow(prefix string, raw json.RawMessage, out []tableCell) ([]tableCell, error) {
+	iter := jsonit.BorrowIterator(raw)
+	defer jsonit.ReturnIterator(iter)
+	if iter.WhatIsNext() != jsoniter.ObjectValue {
+		if prefix == "" {
+			prefix = "value"
+		}
+		return append(out, tableCell{name: prefix, value: raw}), nil
+	}
+	var err error
+	empty := true
+	iter.ReadObjectCB(func(it *jsoniter.Iterator, key string) bool {
+		empty = false
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		out, err = flattenRow(name, it.SkipAndReturnBytes(), out)
+		return err == nil
+	})
+	if err == nil {
+		err = iter.Error
+	}
+	if empty && prefix != "" {
+		out = append(out, tableCell{name: prefix, value: raw})
+	}
+	return out, err
+}
+
+// The value at a path into a row, by object key or array index.
+func lookupPath(raw json.RawMessage, path []string) (json.RawMessage, bool) {
+	for _, seg := range path {
+		trimmed := bytes.TrimSpace(raw)
+		if len(trimmed) == 0 {
+			return nil, false
+		}
+		switch trimmed[0] {
+		case '{':
+			var obj map[string]json.RawMessage
+			if jsonit.Unmarshal(trimmed, &obj) != nil {
+				return nil, false
+			}
+			v, ok := obj[seg]
+			if !ok {
+				return nil, false
+			}
+			raw = v
+		case '[':
+			var arr []json.RawMessage
+			i, err := strconv.Atoi(seg)
+			if err != nil || jsonit.Unmarshal(trimmed, &arr) != nil || i < 0 || i >= len(arr) {
+				return nil, false
+			}
+			raw = arr[i]
+		default:
+			return nil, false
+		}
+	}
+	return raw, true
+}
+
+// The text of a csv cell: strings unquoted and made safe, null empty, and other values as compact json.
+func cellText(raw json.RawMessage) string {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || string(trimmed) == "null" {
+		return ""
+	}
+	if trimmed[0] == '"' {
+		var s string
+		if jsonit.Unmarshal(trimmed, &s) == nil {
+			return csvSafe(s)
+		}
+	}
+	var out bytes.Buffer
+	if json.Compact(&out, trimmed) != nil {
+		return string(trimmed)
+	}
+	return out.String()
+}
+
+// Cells are chain data, much of it written by anyone, such as titles and memos. Those that a spreadsheet would
+// take as a formula are prefixed with a quote, so that they are shown as text instead.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// Writes a json RPC response as a table. Responses without rows, such as errors, are left to be written as json.
+func writeTable(w http.ResponseWriter, t restTable, respJson []byte, format string, columns []tableColumn) bool {
+	rows, err := t.rows(respJson)
+	if err != nil {
+		return false
+	}
+	var out []byte
+	if format == formatCSV {
+		out, err = writeCSV(rows, columns)
+	} else {
+		out, err = writeNDJSON(rows, columns)
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return true
+	}
+	w.Header().Set("Content-Type", formatTypes[format])
+	w.Write(out)
+	return true
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// A resource of the v2 REST API, served by composing routed json RPC calls.
+type v2Route struct {
+	// Path below /v2/, with {name} segments matching any value.
+	path    string
+	params  []restParam
+	desc    string
+	example string // The data of a response, for the API document.
+	// Params a cursor may set, for listings.
+	keys []string
+	// Gives the resource's data, from the path values and the typed query params.
+	handler func(vr *v2Request, vars map[string]string, params map[string]interface{}) (interface{}, error)
+}
+
+var v2Routes = []v2Route{
+	{path: "accounts/{name}", desc: "An account.", handler: v2Account,
+		example: `{"id": 28, "name": "alice", "balance": "1.000 HIVE", "hbd_balance": "0.000 HBD", "vesting_shares": "2040.123456 VESTS", "post_count": 12}`},
+	{path: "accounts/{name}/history", desc: "An account's operations, oldest first, up to start.", handler: v2AccountHistory, keys: []string{"start", "limit"},
+		example: `[{"seq": 12, "trx_id": "3f0e4d3c4e1c3cbe8e3f3a4e7a1c0d2b5e6f7a8b", "block": 59999990, "timestamp": "2021-12-13T11:30:06", "op": ["vote", {"voter": "alice", "author": "bob", "permlink": "hello", "weight": 10000}]}]`, params: []restParam{
+			{name: "start", kind: paramInteger, def: json.Number("-1"), desc: "Sequence number of the last operation, -1 for the latest."},
+			{name: "limit", kind: paramInteger, def: json.Number("100"), desc: "At most 1000."},
+		}},
+	{path: "blocks/{num}", desc: "A block.", handler: v2Block,
+		example: `{"block_num": 60000000, "previous": "0393886fe4a2b6a04cf5ee39e2bc55ccfbc9bbea", "timestamp": "2021-12-13T11:30:36", "witness": "blocktrades", "transactions": []}`},
+	{path: "blocks/{num}/ops", desc: "The operations of a block, including virtual ones.", handler: v2BlockOps, params: []restParam{
+		{name: "only_virtual", kind: paramBoolean, def: false},
+	}},
+	{path: "posts/{author}/{permlink}", desc: "A post or comment.", handler: v2Post},
+	{path: "posts/{author}/{permlink}/replies", desc: "The direct replies to a post or comment.", handler: v2PostReplies},
+	{path: "witnesses", desc: "Witnesses by vote, from start.", handler: v2Witnesses, keys: []string{"start"},
+		example: `[{"owner": "blocktrades", "votes": "120000000000000000", "url": "https://hive.blog/@blocktrades", "running_version": "1.25.0"}]`, params: []restParam{
+			{name: "start", kind: paramString, def: ""},
+			{name: "limit", kind: paramInteger, def: json.Number("100"), desc: "At most 1000."},
+		}},
+}
+
+// Body of v2 responses: the data on success, or the error.
+type v2Response struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *v2Error    `json:"error,omitempty"`
+	// The cursor of the next page of a listing, and the link to it.
+	Cursor string `json:"cursor,omitempty"`
+	Next   string `json:"next,omitempty"`
+}
+
+type v2Error struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// The calls made for a v2 request, and how long their responses may be cached for.
+type v2Request struct {
+	ctx    context.Context
+	client string
+	maxAge time.Duration
+	calls  []rpcCall
+	// The cursor the request was made with, and the one the handler gives for the next page.
+	cursor *restCursor
+	next   *restCursor
+}
+
+// Makes a json RPC call through the usual routing and cache, decoding its result into out.
+// A null result is taken as the resource not existing.
+func (vr *v2Request) call(method string, params interface{}, out interface{}) error {
+	call, result, err := routedCall(vr.ctx, vr.client, method, params)
+	if call.requestJson == nil {
+		return err
+	}
+	vr.calls = append(vr.calls, call)
+	ttl := cacheTTL(call)
+	if ttl == cache.DefaultExpiration {
+		ttl = respCacheTime
+	}
+	if vr.maxAge < 0 || ttl < vr.maxAge {
+		vr.maxAge = ttl
+	}
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return newStatusError(http.StatusNotFound, "")
+	}
+	if err := jsonit.Unmarshal(result, out); err != nil {
+		log.Println("Couldn't match result type of", method)
+		log.Println(err)
+		return newStatusError(http.StatusBadGateway, "")
+	}
+	return nil
+}
+
+// Makes a json RPC call for a client through the usual routing and cache. Gives the call, if it was made, and its
+// result, which is nil if null.
+func routedCall(ctx context.Context, client string, method string, params interface{}) (rpcCall, json.RawMessage, error) {
+	reqmessage := map[string]interface{}{"jsonrpc": "2.0", "id": "0", "method": method, "params": params}
+	call, status := normalizeRequest(reqmessage)
+	if status != http.StatusOK {
+		return rpcCall{}, nil, newStatusError(status, "")
+	}
+	status, respJson, cached := fetchResponse(jobContext(ctx, client, call.method), call)
+	if status != http.StatusOK {
+		return rpcCall{}, nil, newStatusError(status, "")
+	}
+	if !cached {
+		checkDatabaseLock(call, respJson)
+	}
+
+	var resp rpcResponse
+	if err := jsonit.Unmarshal(respJson, &resp); err != nil {
+		log.Println("Couldn't match response type of", method)
+		return call, nil, newStatusError(http.StatusBadGateway, "")
+	}
+	if resp.Error != nil {
+		return call, nil, resp.Error
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" {
+		return call, nil, nil
+	}
+	return call, resp.Result, nil
+}
+
+func doHandleV2(w http.ResponseWriter, r *http.Request) {
+	mark := time.Now()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeV2Error(w, newStatusError(http.StatusMethodNotAllowed, ""))
+		return
+	}
+
+	route, vars, ok := matchV2Route(strings.TrimPrefix(r.URL.EscapedPath(), "/v2/"))
+	if !ok {
+		writeV2Error(w, newStatusError(http.StatusNotFound, "No such resource"))
+		return
+	}
+	q := r.URL.Query()
+	var cursor *restCursor
+	hash := cursorHash(r.URL.Path, q)
+	if len(route.keys) > 0 {
+		if c := q.Get(cursorParam); c != "" {
+			var err error
+			if cursor, err = decodeCursor(c, hash); err != nil {
+				writeV2Error(w, err)
+				return
+			}
+		}
+		delete(q, cursorParam)
+	}
+	var fields projection
+	if list, ok := q[fieldsParam]; ok {
+		delete(q, fieldsParam)
+		var err error
+		if fields, err = parseFields(list); err != nil {
+			writeV2Error(w, newStatusError(http.StatusBadRequest, "Bad fields: "+err.Error()))
+			return
+		}
+	}
+	params, err := buildRESTParams(route.params, q, nil, "/v2/"+route.path)
+	if err == nil && cursor != nil {
+		err = restPager{keys: route.keys}.prepare(params, cursor, "/v2/"+route.path)
+	}
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	vr := &v2Request{ctx: r.Context(), client: clientIdentity(r), maxAge: -1, cursor: cursor}
+	data, err := route.handler(vr, vars, params)
+	if err == nil && fields != nil {
+		data, err = projectData(data, fields)
+	}
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+	resp := v2Response{Data: data}
+	if vr.next != nil {
+		vr.next.Hash = hash
+		resp.Cursor = vr.next.encode()
+		resp.Next = nextPageLink(r, vr.next)
+		w.Header().Set("Link", "<"+resp.Next+">; rel=\"next\"")
+	}
+	body, err := jsonit.Marshal(resp)
+	if err != nil {
+		log.Println("Couldn't marshal v2 response:", err)
+		writeV2Error(w, newStatusError(http.StatusInternalServerError, ""))
+		return
+	}
+
+	// Responses are built from cached calls, so may be cached downstream for as long as the shortest lived of them.
+	sum := sha256.Sum256(body)
+	// Weak, as the body may be sent compressed.
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(vr.maxAge/time.Second)))
+	if strings.Contains(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+
+	if debug {
+		for _, call := range vr.calls {
+			log.Println(time.Since(mark), r.URL.Path, call.target, "-d '"+string(call.requestJson)+"'")
+		}
+	}
+}
+
+// Applies a projection to the data of a response.
+func projectData(data interface{}, fields projection) (interface{}, error) {
+	raw, err := jsonit.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return fields.apply(raw)
+}
+
+// Finds the route for a path below /v2/, with the values of its {name} segments.
+func matchV2Route(p string) (v2Route, map[string]string, bool) {
+	segs := strings.Split(strings.TrimSuffix(p, "/"), "/")
+	for _, route := range v2Routes {
+		rsegs := strings.Split(route.path, "/")
+		if len(rsegs) != len(segs) {
+			continue
+		}
+		vars := make(map[string]string)
+		matched := true
+		for i, rs := range rsegs {
+			if strings.HasPrefix(rs, "{") {
+				v, err := url.PathUnescape(segs[i])
+				if err != nil || v == "" {
+					matched = false
+					break
+				}
+				vars[strings.Trim(rs, "{}")] = v
+			} else if rs != segs[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route, vars, true
+		}
+	}
+	return v2Route{}, nil, false
+}
+
+// Writes an error in the v2 shape. Upstream errors are taken as the request being bad.
+func writeV2Error(w http.ResponseWriter, err error) {
+	verr := &v2Error{Status: http.StatusInternalServerError}
+	var rerr *rpcError
+	var serr *statusError
+	switch {
+	case errors.As(err, &rerr):
+		verr.Status = http.StatusBadRequest
+		verr.Message = rerr.Message
+	case errors.As(err, &serr):
+		verr.Status = serr.status
+		verr.Message = serr.Error()
+	default:
+		log.Println("v2 error:", err)
+	}
+	if verr.Message == "" {
+		verr.Message = http.StatusText(verr.Status)
+	}
+	body, _ := jsonit.Marshal(v2Response{Error: verr})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(verr.Status)
+	w.Write(body)
+}
+
+// Parses a block number path value.
+func v2BlockNum(s string) (int64, error) {
+	num, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || num < 1 {
+		return 0, newStatusError(http.StatusBadRequest, "Bad block number "+strconv.Quote(s))
+	}
+	return num, nil
+}
+
+// Checks a page limit.
+func v2Limit(params map[string]interface{}) (json.Number, error) {
+	limit := params["limit"].(json.Number)
+	if n, err := limit.Int64(); err != nil || n < 1 || n > maxPageLimit {
+		return "", newStatusError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageLimit))
+	}
+	return limit, nil
+}
+
+func v2Account(vr *v2Request, vars map[string]string, _ map[string]interface{}) (interface{}, error) {
+	var accounts []json.RawMessage
+	if err := vr.call("condenser_api.get_accounts", []interface{}{[]string{vars["name"]}}, &accounts); err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, newStatusError(http.StatusNotFound, "No account "+strconv.Quote(vars["name"]))
+	}
+	return accounts[0], nil
+}
+
+// Operations are given as objects, with their sequence number alongside the block, transaction and op.
+func v2AccountHistory(vr *v2Request, vars map[string]string, params map[string]interface{}) (interface{}, error) {
+	limit, err := v2Limit(params)
+	if err != nil {
+		return nil, err
+	}
+	var history []json.RawMessage
+	if err := vr.call("condenser_api.get_account_history", []interface{}{vars["name"], params["start"], limit}, &history); err != nil {
+		return nil, err
+	}
+	ops := make([]map[string]json.RawMessage, 0, len(history))
+	for _, raw := range history {
+		var entry [2]json.RawMessage
+		var op map[string]json.RawMessage
+		if jsonit.Unmarshal(raw, &entry) != nil || jsonit.Unmarshal(entry[1], &op) != nil || op == nil {
+			return nil, newStatusError(http.StatusBadGateway, "")
+		}
+		op["seq"] = entry[0]
+		ops = append(ops, op)
+	}
+	if next, _ := historyNext(params, history); next != nil {
+		vr.next = &restCursor{Params: next}
+	}
+	return ops, nil
+}
+
+// The block is given with its number, which the chain leaves implicit.
+func v2Block(vr *v2Request, vars map[string]string, _ map[string]interface{}) (interface{}, error) {
+	num, err := v2BlockNum(vars["num"])
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Block map[string]json.RawMessage `json:"block"`
+	}
+	if err := vr.call("block_api.get_block", map[string]interface{}{"block_num": num}, &result); err != nil {
+		return nil, err
+	}
+	if result.Block == nil {
+		return nil, newStatusError(http.StatusNotFound, "No block "+vars["num"])
+	}
+	result.Block["block_num"] = json.RawMessage(strconv.FormatInt(num, 10))
+	return result.Block, nil
+}
+
+func v2BlockOps(vr *v2Request, vars map[string]string, params map[string]interface{}) (interface{}, error) {
+	num, err := v2BlockNum(vars["num"])
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Ops []json.RawMessage `json:"ops"`
+	}
+	req := map[string]interface{}{"block_num": num, "only_virtual": params["only_virtual"]}
+	if err := vr.call("account_history_api.get_ops_in_block", req, &result); err != nil {
+		return nil, err
+	}
+	if result.Ops == nil {
+		result.Ops = []json.RawMessage{}
+	}
+	return result.Ops, nil
+}
+
+func v2Post(vr *v2Request, vars map[string]string, _ map[string]interface{}) (interface{}, error) {
+	var post map[string]json.RawMessage
+	if err := vr.call("condenser_api.get_content", []interface{}{vars["author"], vars["permlink"]}, &post); err != nil {
+		return nil, err
+	}
+	// Missing posts come back as an empty one.
+	if a, ok := post["author"]; !ok || string(a) == `""` {
+		return nil, newStatusError(http.StatusNotFound, "No post @"+vars["author"]+"/"+vars["permlink"])
+	}
+	return post, nil
+}
+
+func v2PostReplies(vr *v2Request, vars map[string]string, _ map[string]interface{}) (interface{}, error) {
+	replies := []json.RawMessage{}
+	if err := vr.call("condenser_api.get_content_replies", []interface{}{vars["author"], vars["permlink"]}, &replies); err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// Pages start at the owner of the last witness of the previous page, which is dropped.
+func v2Witnesses(vr *v2Request, _ map[string]string, params map[string]interface{}) (interface{}, error) {
+	limit, err := v2Limit(params)
+	if err != nil {
+		return nil, err
+	}
+	witnesses := []json.RawMessage{}
+	if err := vr.call("condenser_api.get_witnesses_by_vote", []interface{}{params["start"], limit}, &witnesses); err != nil {
+		return nil, err
+	}
+	if next, _ := witnessOrderNext(params, witnesses); next != nil {
+		vr.next = &restCursor{Params: next, Skip: true}
+	}
+	if vr.cursor != nil && vr.cursor.Skip && len(witnesses) > 0 {
+		witnesses = witnesses[1:]
+	}
+	return witnesses, nil
+}
+
+// Witnesses by vote continue from the owner of the last one. The listing has no order param, so its order is "".
+var witnessOrderNext = orderedNext(map[string]pageOrder{"": {fields: []string{"owner"}}})
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	runtimedebug "runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Per connection limits for websocket clients.
+const (
+	wsMaxMessageSize = 1 << 20
+	wsMaxInFlight    = 32 // Requests being served at once, counting each of a batch. Reading more messages waits for one to finish.
+	wsMaxBatch       = 50
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// This is a public api, usable from any origin.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Open websocket connections, so that they can be closed and waited for on shutdown.
+var wsConns = struct {
+	sync.Mutex
+	closing bool
+	conns   map[*websocket.Conn]bool
+	wg      sync.WaitGroup
+}{conns: make(map[*websocket.Conn]bool)}
+
+// Serves json RPC over a websocket. Each message is a request or a batch, and is handled like a request to doHandleReg.
+// Responses are written as they complete, so may be out of order; clients match them by id.
+func doHandleWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error.
+		return
+	}
+	wsConns.Lock()
+	if wsConns.closing {
+		wsConns.Unlock()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsWriteWait))
+		conn.Close()
+		return
+	}
+	wsConns.conns[conn] = true
+	wsConns.wg.Add(1)
+	wsConns.Unlock()
+	defer func() {
+		wsConns.Lock()
+		delete(wsConns.conns, conn)
+		wsConns.Unlock()
+		wsConns.wg.Done()
+	}()
+
+	send := make(chan []byte, wsMaxInFlight)
+	writerDone := make(chan struct{})
+	go wsWriter(conn, send, writerDone)
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	wc := &wsConn{ctx: r.Context(), client: clientIdentity(r), limiter: requestPolicy(r).limiter, inflight: make(chan struct{}, wsMaxInFlight)}
+	var pending sync.WaitGroup
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if debug && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("Websocket read:", err)
+			}
+			break
+		}
+		// A successful read means the client is alive, as much as a pong does.
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		wc.inflight <- struct{}{}
+		pending.Add(1)
+		go func() {
+			defer func() {
+				<-wc.inflight
+				pending.Done()
+			}()
+			send <- wc.handleMessage(msg)
+		}()
+	}
+
+	// Let requests already being served finish, then close.
+	pending.Wait()
+	close(send)
+	<-writerDone
+}
+
+// Writes responses and keepalive pings to a websocket, until send is closed.
+func wsWriter(conn *websocket.Conn, send chan []byte, done chan struct{}) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+		close(done)
+	}()
+	for {
+		select {
+		case msg, ok := <-send:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				// Keep consuming, so that pending requests are not blocked on a dead connection.
+				for range send {
+				}
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				for range send {
+				}
+				return
+			}
+		}
+	}
+}
+
+// A websocket connection's client, and the slots for the requests it has in flight.
+type wsConn struct {
+	ctx    context.Context
+	client string
+	// The rate limiter of a public listener, charged for each request as the upgrade only counted once.
+	limiter  *rateLimiter
+	inflight chan struct{}
+}
+
+// Handles one websocket message, holding one of the in flight slots, returning the response to write.
+func (wc *wsConn) handleMessage(msg []byte) (out []byte) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Println("Recovered panic serving websocket message:", rec)
+			log.Println(string(runtimedebug.Stack()))
+			out = internalErrorJson
+		}
+	}()
+
+	var f interface{}
+	if err := jsonit.Unmarshal(msg, &f); err != nil {
+		out, _ = jsonit.Marshal(rpcErrorResponse(nil, &rpcError{Code: -32700, Message: "Parse error"}))
+		return out
+	}
+
+	var resp interface{}
+	switch req := f.(type) {
+	case []interface{}:
+		if len(req) == 0 || len(req) > wsMaxBatch {
+			resp = rpcErrorResponse(nil, statusRPCError(http.StatusRequestEntityTooLarge))
+			break
+		}
+		resp = wc.serveBatch(req)
+	default:
+		resp = wc.serve(req)
+	}
+	out, err := jsonit.Marshal(resp)
+	if err != nil {
+		log.Println("Couldn't marshal websocket response")
+		log.Println(err)
+		return internalErrorJson
+	}
+	return out
+}
+
+// Serves the requests of a batch with the message's own slot, and as many more in flight slots as are free,
+// so that batches cannot take a connection past its limit.
+func (wc *wsConn) serveBatch(req []interface{}) []interface{} {
+	results := make([]interface{}, len(req))
+	next := int64(-1)
+	work := func() {
+		for {
+			i := int(atomic.AddInt64(&next, 1))
+			if i >= len(req) {
+				return
+			}
+			results[i] = wc.serve(req[i])
+		}
+	}
+	var wg sync.WaitGroup
+extra:
+	for n := 1; n < len(req); n++ {
+		select {
+		case wc.inflight <- struct{}{}:
+		default:
+			break extra
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-wc.inflight
+				wg.Done()
+			}()
+			work()
+		}()
+	}
+	work()
+	wg.Wait()
+	return results
+}
+
+// Serves a single request of a message, if the client is within its rate limit.
+func (wc *wsConn) serve(f interface{}) interface{} {
+	if wc.limiter != nil && !wc.limiter.allow(wc.client) {
+		var id interface{}
+		if reqmessage, ok := f.(map[string]interface{}); ok {
+			id = reqmessage["id"]
+		}
+		return rpcErrorResponse(id, statusRPCError(http.StatusTooManyRequests))
+	}
+	return serveRPCMessage(wc.ctx, wc.client, f)
+}
+
+// Serves a single decoded json RPC request through normalization, routing and the cache, returning the response object.
+// Failures are returned as json RPC error responses.
+func serveRPCMessage(ctx context.Context, client string, f interface{}) interface{} {
+	mark := time.Now()
+	reqmessage, ok := f.(map[string]interface{})
+	if !ok {
+		return rpcErrorResponse(nil, statusRPCError(http.StatusBadRequest))
+	}
+	call, status := normalizeRequest(reqmessage)
+	if status != http.StatusOK {
+		return rpcErrorResponse(call.id, statusRPCError(status))
+	}
+	status, respJson, gcached := fetchResponse(jobContext(ctx, client, call.method), call)
+	if status != http.StatusOK {
+		return rpcErrorResponse(call.id, statusRPCError(status))
+	}
+	if !gcached {
+		checkDatabaseLock(call, respJson)
+	}
+	logCall(call, mark, gcached)
+	if call.id == "0" {
+		return json.RawMessage(respJson)
+	}
+	return restoreID(call, respJson)
+}
+
+func rpcErrorResponse(id interface{}, rerr *rpcError) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "error": rerr, "id": id}
+}
+
+// Closes websocket connections for shutdown, letting requests already being served finish.
+func closeWebSockets(ctx context.Context) error {
+	wsConns.Lock()
+	wsConns.closing = true
+	for conn := range wsConns.conns {
+		// Unblocks the reader, which then finishes the connection.
+		conn.SetReadDeadline(time.Now())
+	}
+	wsConns.Unlock()
+	return waitGroupContext(ctx, &wsConns.wg)
+}
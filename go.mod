@@ -1,9 +1,11 @@
 module github.com/ScottSallinen/goHiveProxy
 
-go 1.19
+go 1.24
 
 require (
+	github.com/gorilla/websocket v1.5.3
 	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.18.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/sergi/go-diff v1.3.1
 )